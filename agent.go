@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// fingerprintAttribute is the guest attribute where the agents publish the SHA-256
+// fingerprint of their self-signed certificate.
+const fingerprintAttribute = "c553/fingerprint"
+
+// Agent talks to the agents of a render server. Its connections only accept the
+// certificate whose fingerprint was published by the server.
+type Agent struct {
+	BaseURL     string
+	Fingerprint string
+
+	// client is for short requests.
+	client *http.Client
+	// transfer is for uploads and downloads. They are limited by the contexts of
+	// their requests as they can take long.
+	transfer *http.Client
+}
+
+func newAgent(instanceIP, fingerprint string) *Agent {
+	transport := httpTransport.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// the certificate is self-signed so it is checked against the fingerprint instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("the render server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return errors.New("the render server's certificate does not match its published fingerprint")
+			}
+			return nil
+		},
+	}
+
+	return &Agent{
+		BaseURL:     "https://" + instanceIP + ":8089",
+		Fingerprint: fingerprint,
+		client:      &http.Client{Transport: transport, Timeout: time.Minute},
+		transfer:    &http.Client{Transport: transport},
+	}
+}
+
+// URL returns the address of an endpoint of the agents.
+func (agent *Agent) URL(path string) string {
+	return agent.BaseURL + path
+}
+
+// get asks the agents for path. The request ends when ctx is cancelled.
+func (agent *Agent) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", agent.URL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	return agent.client.Do(req)
+}
+
+// getFingerprint reads the certificate fingerprint published by a server. It is empty
+// until the agents have started.
+func getFingerprint(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) string {
+	attr, err := computeService.Instances.GetGuestAttributes(conf.Get("project"), conf.Get("zone"), instanceName).
+		VariableKey(fingerprintAttribute).Context(ctx).Do()
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(attr.VariableValue))
+}
+
+// connectAgent waits until the agents of a server have published their certificate and
+// respond. It returns errTimedOut when they don't within timeout.
+func connectAgent(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string,
+	timeout time.Duration) (*Agent, error) {
+	instanceIP, err := getInstanceIP(ctx, computeService, conf.Get("project"), conf.Get("zone"), instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var agent *Agent
+	err = pollUntil(ctx, timeout, 5*time.Second, 30*time.Second, func() (bool, error) {
+		if agent == nil {
+			fingerprint := getFingerprint(ctx, computeService, conf, instanceName)
+			if fingerprint == "" {
+				return false, nil
+			}
+			agent = newAgent(instanceIP, fingerprint)
+		}
+
+		resp, err := agent.get(ctx, "/ready")
+		if err != nil {
+			return false, nil
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return false, nil
+		}
+
+		// the agents of a server are downloaded when it is prepared and the client must
+		// be of the same version to understand them.
+		if strings.TrimSpace(string(raw)) != AppVersion {
+			return false, newError(AgentError, "The agents of the render server '%s' are not of version %s like "+
+				"this program. Delete the server with the del command and re-run prep to make a new one.",
+				instanceName, AppVersion)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return agent, nil
+}
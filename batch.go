@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+)
+
+// batchTmpl is an example batchFile. It is printed by the batch command when it is given
+// no arguments.
+const batchTmpl = `// A batchFile lists the shots to render in one session. Every shot has a number n and
+// the fields below. Only shotn_file is compulsory.
+// shotn_file is the blender file of the shot. It is looked for in the working directory.
+shot1_file: intro.blend
+
+// shotn_scenes, shotn_cameras and shotn_view_layers are the scenes, cameras and view layers
+// to render, separated by commas. Every combination is rendered to its own folder like
+// 'Scene/Camera/'. The active ones are used when empty.
+// A camera can also be a timeline marker bound to a camera.
+shot1_scenes:
+
+shot1_cameras:
+
+shot1_view_layers:
+
+// shotn_frames is a range of frames like '1-120' or a list like '1,5,10..20'.
+// Every frame is rendered when empty.
+shot1_frames:
+
+// shotn_format is the output format like AVIJPEG, FFMPEG, PNG, TIFF or OPEN_EXR.
+// It is AVIJPEG for animations and PNG for stills when empty.
+shot1_format:
+
+// shotn_still is 'yes' to render the shotn_frames as images instead of an animation.
+shot1_still:
+
+// shotn_resolution is the size of the outputs like '3840x2160'. The size set in the file is
+// used when empty.
+shot1_resolution:
+
+// shotn_engine is CYCLES, BLENDER_EEVEE, BLENDER_EEVEE_NEXT or BLENDER_WORKBENCH.
+// The quality of the serverConfigFile picks it when empty.
+shot1_engine:
+
+// shotn_after are the shots to finish before this one, separated by commas.
+// Their outputs are put next to the blender file of this shot in folders named after them
+// so a compositing shot can use the frames of shot1 as '//shot1/'.
+// The shot is skipped when one of them does not render.
+shot1_after:
+
+// shotn_bake is 'yes' to bake the simulations of the file instead of rendering it.
+// A shot after a bake shot renders the baked file when its shotn_file is empty.
+shot1_bake:
+
+shot2_file: outro.blend
+shot2_frames: 1-48
+
+shot3_file: sim.blend
+shot3_bake: yes
+
+shot4_file:
+shot4_after: shot3
+
+shot5_file: comp.blend
+shot5_after: shot1, shot4
+`
+
+var shotKeyRegexp = regexp.MustCompile(
+	`^shot([0-9]+)_(file|scenes|cameras|view_layers|frames|format|engine|still|resolution|after|bake)$`)
+
+// Shot is a blender file to render in a batch.
+type Shot struct {
+	Name        string
+	BlenderPath string
+	Settings    RenderSettings
+
+	// After are the names of the shots to finish before this one.
+	After []string
+	// Bake makes the shot bake the simulations of its file instead of rendering it.
+	Bake bool
+	// From is the bake shot whose baked file is rendered when the shot has no file.
+	From string
+}
+
+// ShotResult is the outcome of a shot in a batch.
+type ShotResult struct {
+	Name       string `json:"name"`
+	File       string `json:"file"`
+	Status     string `json:"status"`
+	OutputPath string `json:"output_path,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// loadBatchFile reads the shots of a batchFile in the order of their numbers.
+func loadBatchFile(rootPath, batchPath string) ([]Shot, error) {
+	conf, err := zazabul.LoadConfigFile(batchPath)
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the batchFile")
+	}
+
+	shotsByNumber := make(map[int]*Shot)
+	for _, item := range conf.Items {
+		parts := shotKeyRegexp.FindStringSubmatch(item.Name)
+		if parts == nil {
+			return nil, newError(ConfigError, "The field '%s' in the batchFile is not like 'shot1_file'", item.Name)
+		}
+		number, _ := strconv.Atoi(parts[1])
+		shot, ok := shotsByNumber[number]
+		if !ok {
+			shot = &Shot{Name: "shot" + parts[1]}
+			shotsByNumber[number] = shot
+		}
+
+		value := strings.TrimSpace(item.Value)
+		switch parts[2] {
+		case "file":
+			if value != "" {
+				shot.BlenderPath = getConfigPath(rootPath, value)
+			}
+		case "scenes":
+			shot.Settings.Scenes = splitNames(value)
+		case "cameras":
+			shot.Settings.Cameras = splitNames(value)
+		case "view_layers":
+			shot.Settings.ViewLayers = splitNames(value)
+		case "frames":
+			shot.Settings.Frames = value
+		case "format":
+			shot.Settings.Format = parseFormat(value)
+		case "engine":
+			shot.Settings.Engine = strings.ToUpper(value)
+		case "after":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					shot.After = append(shot.After, name)
+				}
+			}
+		case "still":
+			shot.Settings.Still = value == "yes" || value == "true"
+		case "resolution":
+			shot.Settings.Resolution = value
+		case "bake":
+			shot.Bake = value == "yes" || value == "true"
+		}
+	}
+
+	numbers := make([]int, 0, len(shotsByNumber))
+	for number := range shotsByNumber {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	shotsByName := make(map[string]*Shot)
+	for _, shot := range shotsByNumber {
+		shotsByName[shot.Name] = shot
+	}
+
+	shots := make([]Shot, 0, len(numbers))
+	for _, number := range numbers {
+		shot := shotsByNumber[number]
+		for _, name := range shot.After {
+			if shotsByName[name] == nil {
+				return nil, newError(ConfigError, "The shot '%s' is after '%s' which is not in the batchFile", shot.Name, name)
+			}
+			if shotsByName[name].Bake && shot.BlenderPath == "" {
+				if shot.From != "" {
+					return nil, newError(ConfigError, "The shot '%s' has no file and is after several bake shots", shot.Name)
+				}
+				shot.From = name
+			}
+		}
+		if shot.BlenderPath == "" && shot.From == "" {
+			return nil, newError(ConfigError, "The shot '%s' has no file", shot.Name)
+		}
+		if shot.From != "" && shot.Bake {
+			return nil, newError(ConfigError, "The shot '%s' can't bake a baked file", shot.Name)
+		}
+		if shot.From == "" && !DoesPathExists(shot.BlenderPath) {
+			return nil, newError(ConfigError, "The file '%s' of the shot '%s' does not exist", shot.BlenderPath, shot.Name)
+		}
+		if err := shot.Settings.validate(); err != nil {
+			return nil, errors.Wrap(err, "in the shot '"+shot.Name+"'")
+		}
+		shots = append(shots, *shot)
+	}
+	if len(shots) == 0 {
+		return nil, newError(ConfigError, "The batchFile '%s' has no shots", batchPath)
+	}
+
+	return orderShots(shots)
+}
+
+// orderShots sorts shots so that every shot comes after the shots it waits for. Shots
+// keep the order of their numbers otherwise.
+func orderShots(shots []Shot) ([]Shot, error) {
+	ordered := make([]Shot, 0, len(shots))
+	placed := make(map[string]bool)
+	for len(ordered) < len(shots) {
+		progressed := false
+		for _, shot := range shots {
+			if placed[shot.Name] {
+				continue
+			}
+			ready := true
+			for _, name := range shot.After {
+				if !placed[name] {
+					ready = false
+				}
+			}
+			if ready {
+				ordered = append(ordered, shot)
+				placed[shot.Name] = true
+				progressed = true
+			}
+		}
+
+		if !progressed {
+			waiting := make([]string, 0)
+			for _, shot := range shots {
+				if !placed[shot.Name] {
+					waiting = append(waiting, shot.Name)
+				}
+			}
+			return nil, newError(ConfigError, "The shots %s wait for each other", strings.Join(waiting, ", "))
+		}
+	}
+
+	return ordered, nil
+}
+
+// doBatch renders every shot of a batchFile in one session. The server is started once,
+// every shot is queued on it and the outputs of each shot are downloaded as soon as it
+// is done. The server is stopped at the end. The blender files are always uploaded
+// directly to the server even when the serverConfigFile has a bucket.
+func doBatch(ctx context.Context, batchPath, serverConfigPath string, opts RenderOptions) (result *CommandResult, err error) {
+	rootPath, _ := GetRootPath()
+
+	conf, instanceName, err := loadFreeServer(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	timeouts, _ := getTimeouts(conf)
+
+	shots, err := loadBatchFile(rootPath, batchPath)
+	if err != nil {
+		return nil, err
+	}
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	machineType, err := serverMachineType(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the shots are cancelled and the server parked when the batch fails or is interrupted.
+	var agent *Agent
+	stopped := false
+	defer func() {
+		if err == nil || stopped {
+			return
+		}
+		cancelRender(agent, "")
+		stopErr := parkInstance(context.Background(), computeService, conf, instanceName)
+		if stopErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(stopErr.Error()))
+		}
+	}()
+
+	beginTime := time.Now()
+	agent, err = startServer(ctx, computeService, conf, serverConfigPath, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the shots are ordered so the jobs they wait for are always queued before them.
+	jobIDs := make([]string, len(shots))
+	jobIDsByName := make(map[string]string)
+	results := make([]ShotResult, len(shots))
+	for i, shot := range shots {
+		if shot.Settings.Engine == "" {
+			shot.Settings.Engine = qualityEngines[conf.Get("quality")]
+		}
+		form := shot.Settings.form()
+		after := make([]string, 0, len(shot.After))
+		for _, name := range shot.After {
+			after = append(after, name+"="+jobIDsByName[name])
+		}
+		form.Set("after", strings.Join(after, ","))
+
+		if shot.From != "" {
+			jobIDs[i], err = queueBaked(ctx, agent, jobIDsByName[shot.From], form)
+		} else {
+			if shot.Bake {
+				form.Set("bake", "true")
+			}
+			jobIDs[i], err = submitBlend(ctx, agent, shot.BlenderPath, form, timeouts.Upload)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not queue "+shot.Name)
+		}
+		jobIDsByName[shot.Name] = jobIDs[i]
+		results[i] = ShotResult{Name: shot.Name, File: shot.BlenderPath, Status: "queued"}
+		if shot.From != "" {
+			fmt.Fprintf(out, "Queued %s (baked by %s)\n", shot.Name, shot.From)
+		} else {
+			fmt.Fprintf(out, "Queued %s (%s)\n", shot.Name, filepath.Base(shot.BlenderPath))
+		}
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Click %s to download a preview of your render while it renders.\n", agent.URL("/dlv/"))
+	fmt.Fprintf(out, "The render server's certificate is self-signed. Its SHA-256 fingerprint is %s\n",
+		agent.Fingerprint)
+
+	outDir := filepath.Join(rootPath, strings.TrimSuffix(filepath.Base(batchPath), filepath.Ext(batchPath))+"-"+
+		time.Now().Format(VersionFormat))
+	renderTime := time.Now()
+	renderTimeout := timeouts.Render * time.Duration(len(shots))
+	finished := 0
+	poller := &statusPoller{}
+	err = pollUntil(ctx, renderTimeout, 10*time.Second, time.Minute, func() (bool, error) {
+		for i := range shots {
+			if results[i].Status != "queued" {
+				continue
+			}
+			agentJob, err := poller.job(ctx, agent, jobIDs[i])
+			if err != nil {
+				return false, err
+			}
+			if agentJob == nil || !agentJob.IsFinished() {
+				continue
+			}
+
+			finished += 1
+			results[i].Status = agentJob.Status
+			results[i].Error = agentJob.Error
+			if agentJob.Status != "done" {
+				fmt.Fprintln(out, color.Red.Sprintf("\n%s %s: %s", shots[i].Name, agentJob.Status, agentJob.Error))
+				continue
+			}
+			// the baked files stay on the server for the shots after the bake.
+			if shots[i].Bake {
+				fmt.Fprintf(out, "\n%s baked\n", shots[i].Name)
+				continue
+			}
+
+			shotDir := filepath.Join(outDir, shots[i].Name)
+			err = downloadJobOutputs(ctx, agent, jobIDs[i], shotDir, opts.ExistsPolicy, opts.Archive)
+			if err != nil {
+				return false, errors.Wrap(err, "could not download "+shots[i].Name)
+			}
+			results[i].OutputPath = shotDir
+			fmt.Fprintf(out, "\n%s rendered to %s\n", shots[i].Name, shotDir)
+		}
+		if finished == len(shots) {
+			return true, nil
+		}
+
+		fmt.Fprintf(out, "\rBeen rendering for: %s (%d of %d shots done)  ",
+			time.Since(renderTime).Round(time.Second).String(), finished, len(shots))
+		return false, nil
+	})
+	if err == errTimedOut {
+		return nil, timeoutError(RenderError, "the batch", renderTimeout)
+	}
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) && c553Err.Kind == InterruptError {
+		return nil, newError(InterruptError, "The batch was cancelled.")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = parkInstance(context.Background(), computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	stopped = true
+	fmt.Fprintf(out, "Server %s.\n", parkedState(conf))
+
+	duration := time.Since(beginTime)
+	cost := estimateCost(context.Background(), computeService, conf, machineType, duration)
+	fmt.Fprintf(out, "Estimated cost: $%.2f\n", cost)
+
+	result = &CommandResult{
+		Command:       "batch",
+		Instance:      instanceName,
+		ConfigPath:    serverConfigPath,
+		OutputPath:    outDir,
+		MachineType:   machineType,
+		Duration:      duration.Seconds(),
+		EstimatedCost: cost,
+		Shots:         results,
+	}
+
+	// the result is kept with the error so that the shots which rendered and the cost are
+	// still recorded.
+	failed := make([]string, 0)
+	for _, shotResult := range results {
+		if shotResult.Status != "done" {
+			failed = append(failed, shotResult.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return result, newError(RenderError, "%d of %d shots did not render: %s. The others are in '%s'", len(failed),
+			len(shots), strings.Join(failed, ", "), outDir)
+	}
+	return result, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// defaultBenchMachineTypes are benchmarked along with the machine_type of the serverConfigFile
+// when the --machine-types flag is not given.
+var defaultBenchMachineTypes = []string{"e2-highcpu-8", "e2-highcpu-16", "e2-highcpu-32", "n2-highcpu-64"}
+
+// The sample the bench command renders when the --frames and --resolution flags are not given.
+const (
+	defaultBenchFrames     = "1-3"
+	defaultBenchResolution = "960x540"
+)
+
+// BenchResult is how fast and how costly a machine type renders the sample of the bench
+// command.
+type BenchResult struct {
+	MachineType     string  `json:"machine_type"`
+	Frames          int     `json:"frames,omitempty"`
+	SecondsPerFrame float64 `json:"seconds_per_frame,omitempty"`
+	CostPerFrame    float64 `json:"cost_per_frame_usd,omitempty"`
+	// EstimatedCost is what running the server for the sample cost.
+	EstimatedCost float64 `json:"estimated_cost_usd"`
+	MeetsTarget   bool    `json:"meets_target,omitempty"`
+	Recommended   bool    `json:"recommended,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// BenchOptions are the flags of the bench command.
+type BenchOptions struct {
+	MachineTypes []string
+	// Target is the longest a frame may take. The cheapest machine type per frame is
+	// recommended when it is zero.
+	Target   time.Duration
+	Settings RenderSettings
+}
+
+// doBench renders a sample of a blender file on each machine type in turn with the same
+// server and recommends the cheapest which renders a frame within the target. The server
+// is changed back to its machine type when done.
+func doBench(ctx context.Context, blenderPath, serverConfigPath string, opts BenchOptions) (result *CommandResult, err error) {
+	rootPath, _ := GetRootPath()
+
+	conf, instanceName, err := loadFreeServer(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	timeouts, _ := getTimeouts(conf)
+
+	settings := opts.Settings
+	settings.Still = true
+	if settings.Frames == "" {
+		settings.Frames = defaultBenchFrames
+	}
+	if settings.Resolution == "" {
+		settings.Resolution = defaultBenchResolution
+	}
+	if settings.Engine == "" {
+		settings.Engine = qualityEngines[conf.Get("quality")]
+	}
+	err = settings.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	machineTypes := opts.MachineTypes
+	if len(machineTypes) == 0 {
+		machineTypes = append([]string{conf.Get("machine_type")}, defaultBenchMachineTypes...)
+	}
+	machineTypes = uniqueStrings(machineTypes)
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	// the server may have been started with --machine-type so it is changed back to what it
+	// was and not to the machine_type.
+	priorMachineType, err := serverMachineType(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server is always stopped and changed back, a running server costs money.
+	defer func() {
+		bgCtx := context.Background()
+		stopErr := stopInstance(bgCtx, computeService, conf, instanceName)
+		if stopErr == nil {
+			stopErr = setMachineType(bgCtx, computeService, conf, instanceName, priorMachineType)
+		}
+		if stopErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(stopErr.Error()))
+		}
+	}()
+
+	beginTime := time.Now()
+	results := make([]BenchResult, 0, len(machineTypes))
+	for _, machineType := range machineTypes {
+		fmt.Fprintf(out, "Benchmarking %s\n", machineType)
+		benchResult, err := benchMachineType(ctx, computeService, conf, serverConfigPath, instanceName, machineType,
+			blenderPath, settings, timeouts)
+		var c553Err *C553Error
+		if errors.As(err, &c553Err) && c553Err.Kind == InterruptError {
+			return nil, newError(InterruptError, "The bench was cancelled.")
+		}
+		if err != nil {
+			fmt.Fprintln(out, color.Red.Sprintf("%s: %s", machineType, err))
+			benchResult.Error = err.Error()
+		} else {
+			fmt.Fprintf(out, "%s: %.1fs and $%.4f per frame\n", machineType, benchResult.SecondsPerFrame,
+				benchResult.CostPerFrame)
+		}
+		results = append(results, benchResult)
+	}
+
+	recommendBench(results, opts.Target)
+	printBench(results, opts.Target)
+
+	total := 0.0
+	for _, benchResult := range results {
+		total += benchResult.EstimatedCost
+	}
+	fmt.Fprintf(out, "Estimated cost of the bench: $%.2f\n", total)
+
+	return &CommandResult{
+		Command:       "bench",
+		Instance:      instanceName,
+		ConfigPath:    serverConfigPath,
+		BlenderPath:   blenderPath,
+		Settings:      &settings,
+		Duration:      time.Since(beginTime).Seconds(),
+		EstimatedCost: total,
+		Bench:         results,
+	}, nil
+}
+
+// benchMachineType changes the server to machineType, renders the sample and stops the
+// server. The time per frame is how long the agents took to render the sample.
+func benchMachineType(ctx context.Context, computeService *compute.Service, conf zazabul.Config, serverConfigPath,
+	instanceName, machineType, blenderPath string, settings RenderSettings, timeouts Timeouts) (benchResult BenchResult, err error) {
+	benchResult.MachineType = machineType
+
+	err = stopInstance(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return benchResult, err
+	}
+	err = setMachineType(ctx, computeService, conf, instanceName, machineType)
+	if err != nil {
+		return benchResult, err
+	}
+
+	startTime := time.Now()
+	defer func() {
+		benchResult.EstimatedCost = estimateCost(context.Background(), computeService, conf, machineType,
+			time.Since(startTime))
+	}()
+	agent, err := startServer(ctx, computeService, conf, serverConfigPath, instanceName)
+	if err != nil {
+		return benchResult, err
+	}
+
+	jobID, err := submitBlend(ctx, agent, blenderPath, settings.form(), timeouts.Upload)
+	if err != nil {
+		return benchResult, err
+	}
+	var agentJob *AgentJob
+	poller := &statusPoller{}
+	err = pollUntil(ctx, timeouts.Render, 5*time.Second, 30*time.Second, func() (bool, error) {
+		agentJob, err = poller.job(ctx, agent, jobID)
+		return agentJob != nil && agentJob.IsFinished(), err
+	})
+	if err == errTimedOut {
+		cancelRender(agent, jobID)
+		return benchResult, timeoutError(RenderError, "the sample render", timeouts.Render)
+	}
+	if err != nil {
+		cancelRender(agent, jobID)
+		return benchResult, err
+	}
+	if agentJob.Status != "done" {
+		return benchResult, newError(RenderError, "The sample render %s: %s", agentJob.Status, agentJob.Error)
+	}
+
+	manifest, err := getAgentManifest(ctx, agent, jobID)
+	if err != nil {
+		return benchResult, err
+	}
+	perHour, err := hourlyCost(ctx, computeService, conf, machineType)
+	if err != nil {
+		return benchResult, err
+	}
+
+	// the outputs are only counted when the frames can't be, a render may not have an
+	// output for every frame.
+	benchResult.Frames = settings.frameCount()
+	if benchResult.Frames == 0 {
+		benchResult.Frames = len(manifest.Files)
+	}
+	benchResult.SecondsPerFrame = agentJob.Finished.Sub(agentJob.Started).Seconds() / float64(benchResult.Frames)
+	benchResult.CostPerFrame = perHour * benchResult.SecondsPerFrame / 3600
+
+	err = stopInstance(ctx, computeService, conf, instanceName)
+	return benchResult, err
+}
+
+// recommendBench marks the cheapest machine type per frame among those which render a
+// frame within target. When none does, the fastest is recommended.
+func recommendBench(results []BenchResult, target time.Duration) {
+	best := -1
+	for i, benchResult := range results {
+		if benchResult.Error != "" {
+			continue
+		}
+		results[i].MeetsTarget = target == 0 || benchResult.SecondsPerFrame <= target.Seconds()
+		if !results[i].MeetsTarget {
+			continue
+		}
+		if best == -1 || benchResult.CostPerFrame < results[best].CostPerFrame {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		for i, benchResult := range results {
+			if benchResult.Error != "" {
+				continue
+			}
+			if best == -1 || benchResult.SecondsPerFrame < results[best].SecondsPerFrame {
+				best = i
+			}
+		}
+	}
+	if best != -1 {
+		results[best].Recommended = true
+	}
+}
+
+// printBench prints the machine types from the fastest to the slowest.
+func printBench(results []BenchResult, target time.Duration) {
+	sorted := make([]BenchResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if (sorted[i].Error == "") != (sorted[j].Error == "") {
+			return sorted[i].Error == ""
+		}
+		return sorted[i].SecondsPerFrame < sorted[j].SecondsPerFrame
+	})
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%-20s  %12s  %14s\n", "machine type", "s per frame", "$ per frame")
+	for _, benchResult := range sorted {
+		if benchResult.Error != "" {
+			fmt.Fprintln(out, color.Red.Sprintf("%-20s  failed", benchResult.MachineType))
+			continue
+		}
+		line := fmt.Sprintf("%-20s  %12.1f  %14.4f", benchResult.MachineType, benchResult.SecondsPerFrame,
+			benchResult.CostPerFrame)
+		if benchResult.Recommended {
+			line = color.Green.Sprint(line + "  recommended")
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	for _, benchResult := range results {
+		if !benchResult.Recommended {
+			continue
+		}
+		if target > 0 && !benchResult.MeetsTarget {
+			fmt.Fprintf(out, "No machine type renders a frame within %s. %s is the fastest.\n", target,
+				benchResult.MachineType)
+		} else {
+			fmt.Fprintf(out, "Set machine_type to %s in the serverConfigFile for the cheapest renders.\n",
+				benchResult.MachineType)
+		}
+	}
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
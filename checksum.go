@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Receipt is what the agents report about a blender file they received.
+type Receipt struct {
+	Status string `json:"status"`
+	// Job is the ID of the job the blender file was queued as.
+	Job    string `json:"job"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestEntry is an output of a render as listed by the agents.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest lists the outputs of a render. Paths are relative to the output folder.
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+// fileSHA256 returns the size and SHA-256 of a file.
+func fileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkReceipt compares what the agents received with the file which was sent.
+func checkReceipt(body []byte, localPath string) (*Receipt, error) {
+	receipt := &Receipt{}
+	err := json.Unmarshal(body, receipt)
+	if err != nil || receipt.Status != "ok" {
+		return nil, newError(AgentError, "the render server did not accept the blender file: %s", strings.TrimSpace(string(body)))
+	}
+
+	size, sum, err := fileSHA256(localPath)
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the blender file")
+	}
+	if receipt.Size != size || receipt.SHA256 != sum {
+		return nil, newError(AgentError, "the blender file was corrupted on the way to the render server. "+
+			"Sent %d bytes with SHA-256 %s, received %d bytes with SHA-256 %s", size, sum, receipt.Size, receipt.SHA256)
+	}
+
+	return receipt, nil
+}
+
+// verifyDownloads checks every downloaded file against its manifest entry. The keys of
+// downloads are the local paths. Every mismatch is reported.
+func verifyDownloads(downloads map[string]ManifestEntry) error {
+	mismatches := make([]string, 0)
+	for localPath, entry := range downloads {
+		size, sum, err := fileSHA256(localPath)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("'%s': %s", localPath, err))
+			continue
+		}
+		if size != entry.Size || sum != entry.SHA256 {
+			mismatches = append(mismatches, fmt.Sprintf("'%s': expected %d bytes with SHA-256 %s, got %d bytes with SHA-256 %s",
+				localPath, entry.Size, entry.SHA256, size, sum))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return newError(RenderError, "%d output(s) do not match the render server's manifest. "+
+			"Download them again with --overwrite:\n%s", len(mismatches), strings.Join(mismatches, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// The prices used to estimate the cost of a render when the serverConfigFile does not
+// set vcpu_hour_cost and gb_hour_cost. They are the on-demand prices of e2 machines
+// in us-central1 in US dollars.
+const (
+	defaultVCPUHourCost = 0.021811
+	defaultGBHourCost   = 0.002923
+)
+
+// hourlyCost estimates how much a machine type costs per hour from its vCPUs and memory.
+func hourlyCost(ctx context.Context, computeService *compute.Service, conf zazabul.Config, machineType string) (float64, error) {
+	mt, err := computeService.MachineTypes.Get(conf.Get("project"), conf.Get("zone"), machineType).Context(ctx).Do()
+	if err != nil {
+		return 0, wrapError(ProvisioningError, err, "could not get the machine type's details")
+	}
+
+	vcpuHourCost := defaultVCPUHourCost
+	if value, err := strconv.ParseFloat(conf.Get("vcpu_hour_cost"), 64); err == nil {
+		vcpuHourCost = value
+	}
+	gbHourCost := defaultGBHourCost
+	if value, err := strconv.ParseFloat(conf.Get("gb_hour_cost"), 64); err == nil {
+		gbHourCost = value
+	}
+
+	return float64(mt.GuestCpus)*vcpuHourCost + float64(mt.MemoryMb)/1024*gbHourCost, nil
+}
+
+// estimateCost estimates how much running machineType for duration costs. It is only an
+// estimate so it returns 0 when the machine type's details can't be gotten.
+func estimateCost(ctx context.Context, computeService *compute.Service, conf zazabul.Config, machineType string, duration time.Duration) float64 {
+	perHour, err := hourlyCost(ctx, computeService, conf, machineType)
+	if err != nil {
+		return 0
+	}
+
+	return perHour * duration.Hours()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExistsPolicy is what a download does when its output path already exists.
+type ExistsPolicy int
+
+const (
+	SkipExisting ExistsPolicy = iota
+	OverwriteExisting
+)
+
+// downloadRetries is how many times a failed download is resumed before giving up.
+const downloadRetries = 5
+
+// fetchFunc requests a file from offset onwards. Servers which don't support ranges may
+// send the whole file with a 200 status instead of a 206.
+type fetchFunc func(ctx context.Context, offset int64) (*http.Response, error)
+
+// downloadFile streams the file at url to outPath. It resumes failed downloads and
+// downloads which were interrupted in an earlier run.
+func downloadFile(ctx context.Context, client *http.Client, url, outPath string, policy ExistsPolicy) error {
+	return streamDownload(ctx, outPath, policy, func(ctx context.Context, offset int64) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return client.Do(req)
+	})
+}
+
+// streamDownload writes what fetch returns to a '.part' file next to outPath. It is renamed
+// to outPath once complete so that outPath is never a partial file.
+func streamDownload(ctx context.Context, outPath string, policy ExistsPolicy, fetch fetchFunc) error {
+	if DoesPathExists(outPath) {
+		if policy == SkipExisting {
+			fmt.Fprintf(out, "Skipping '%s' as it already exists. Use --overwrite to replace it.\n", outPath)
+			return nil
+		}
+	}
+
+	os.MkdirAll(filepath.Dir(outPath), 0777)
+	partPath := outPath + ".part"
+
+	var lastErr error
+	for attempt := 0; attempt <= downloadRetries; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintf(out, "\nDownload failed: %s. Resuming.\n", lastErr)
+			select {
+			case <-ctx.Done():
+				return newError(InterruptError, "interrupted while downloading")
+			case <-time.After(time.Duration(attempt*attempt) * time.Second):
+			}
+		}
+
+		complete, err := resumeDownload(ctx, partPath, fetch)
+		if ctx.Err() != nil {
+			return newError(InterruptError, "interrupted while downloading")
+		}
+		var statusErr *downloadStatusError
+		if errors.As(err, &statusErr) && statusErr.code < 500 {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if complete {
+			err = os.Rename(partPath, outPath)
+			if err != nil {
+				return errors.Wrap(err, "os error")
+			}
+			return nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("the file is not complete")
+	}
+	return errors.Wrap(lastErr, "download failed")
+}
+
+// downloadStatusError is a response which is not a file.
+type downloadStatusError struct {
+	code int
+	body string
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("server responded with %d: %s", e.code, e.body)
+}
+
+// resumeDownload appends to partPath what is left of the file. It reports whether the
+// file is complete.
+func resumeDownload(ctx context.Context, partPath string, fetch fetchFunc) (bool, error) {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	resp, err := fetch(ctx, offset)
+	if err != nil {
+		return false, errors.Wrap(err, "http error")
+	}
+	defer resp.Body.Close()
+
+	var flags int
+	var total int64 = -1
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server sent the whole file.
+		offset = 0
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the part file has the whole file when it is the size the server reports. Else it is
+		// left from another file and the file is downloaded again.
+		size := contentRangeSize(resp)
+		if offset > 0 && offset == size {
+			return true, nil
+		}
+		os.Remove(partPath)
+		return false, fmt.Errorf("the partial download has %d bytes but the file has %d", offset, size)
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, &downloadStatusError{code: resp.StatusCode, body: string(body)}
+	}
+
+	partFile, err := os.OpenFile(partPath, flags, 0777)
+	if err != nil {
+		return false, errors.Wrap(err, "os error")
+	}
+	defer partFile.Close()
+
+	progress := &progressWriter{name: filepath.Base(partPath[:len(partPath)-len(".part")]), done: offset, total: total}
+	written, err := io.Copy(partFile, io.TeeReader(resp.Body, progress))
+	progress.finish()
+	if err != nil {
+		return false, errors.Wrap(err, "io error")
+	}
+	// a connection closed early ends the body without an error.
+	if total >= 0 && offset+written != total {
+		return false, fmt.Errorf("got %d of %d bytes", offset+written, total)
+	}
+
+	return true, nil
+}
+
+// contentRangeSize reads the size of the file from a response like 'bytes */1234' to a
+// range which can't be satisfied. It is -1 when the server doesn't tell.
+func contentRangeSize(resp *http.Response) int64 {
+	_, size, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !found {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// progressWriter prints how much of a download is done. Small files are not reported.
+type progressWriter struct {
+	name      string
+	done      int64
+	total     int64
+	lastPrint time.Time
+	printed   bool
+}
+
+// progressThreshold is the size from which downloads report their progress.
+const progressThreshold = 1 << 20
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.done >= progressThreshold && time.Since(p.lastPrint) > 500*time.Millisecond {
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) print() {
+	p.lastPrint = time.Now()
+	p.printed = true
+	if p.total > 0 {
+		fmt.Fprintf(out, "\rDownloading %s: %s of %s (%d%%)  ", p.name, formatBytes(p.done), formatBytes(p.total),
+			p.done*100/p.total)
+	} else {
+		fmt.Fprintf(out, "\rDownloading %s: %s  ", p.name, formatBytes(p.done))
+	}
+}
+
+func (p *progressWriter) finish() {
+	if !p.printed {
+		return
+	}
+	p.print()
+	fmt.Fprintln(out)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return strconv.FormatFloat(float64(n)/(1<<30), 'f', 2, 64) + " GB"
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " B"
+}
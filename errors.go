@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/auth"
+	"github.com/pkg/errors"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorKind is the category of a failure. Each category exits with its own code.
+type ErrorKind int
+
+const (
+	ConfigError ErrorKind = iota + 2
+	AuthError
+	QuotaError
+	ProvisioningError
+	AgentError
+	RenderError
+
+	// InterruptError is used when the user stops a command with Ctrl-C.
+	InterruptError ErrorKind = 130
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ConfigError:       "config",
+	AuthError:         "auth",
+	QuotaError:        "quota",
+	ProvisioningError: "provisioning",
+	AgentError:        "agent",
+	RenderError:       "render",
+	InterruptError:    "interrupted",
+}
+
+func (kind ErrorKind) String() string {
+	return errorKindNames[kind]
+}
+
+// ExitCode is the code the cli exits with for this kind of error.
+func (kind ErrorKind) ExitCode() int {
+	return int(kind)
+}
+
+// C553Error is a categorised error with a message fit for the user.
+type C553Error struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *C553Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *C553Error) Unwrap() error {
+	return e.Err
+}
+
+// newError creates an error of the given kind.
+func newError(kind ErrorKind, format string, a ...any) error {
+	return &C553Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// wrapError gives err the kind and message given. Errors which are already categorised
+// keep their kind and errors from Google Cloud which are about permissions or quota
+// are recategorised.
+func wrapError(kind ErrorKind, err error, message string) error {
+	if err == nil {
+		return nil
+	}
+
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) {
+		return &C553Error{Kind: c553Err.Kind, Message: message, Err: err}
+	}
+
+	return &C553Error{Kind: classifyError(kind, err), Message: message, Err: err}
+}
+
+// quotaReasons are the reasons and operation error codes Google Cloud uses when it does
+// not have enough resources to give.
+var quotaReasons = []string{
+	"quotaExceeded",
+	"rateLimitExceeded",
+	"QUOTA_EXCEEDED",
+	"ZONE_RESOURCE_POOL_EXHAUSTED",
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS",
+}
+
+func isQuotaReason(reason string) bool {
+	for _, quotaReason := range quotaReasons {
+		if reason == quotaReason {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyError(kind ErrorKind, err error) ErrorKind {
+	var authErr *auth.Error
+	if errors.As(err, &authErr) {
+		return AuthError
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, item := range apiErr.Errors {
+			if isQuotaReason(item.Reason) {
+				return QuotaError
+			}
+		}
+		if apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden {
+			return AuthError
+		}
+		if apiErr.Code == http.StatusTooManyRequests {
+			return QuotaError
+		}
+	}
+
+	return kind
+}
+
+// operationError converts the errors of a finished Google Cloud operation to a C553Error.
+func operationError(opErr *compute.OperationError) error {
+	kind := ProvisioningError
+	var messages []string
+	for _, e := range opErr.Errors {
+		messages = append(messages, e.Message)
+		if isQuotaReason(e.Code) {
+			kind = QuotaError
+		}
+	}
+
+	return newError(kind, "operation failed with error(s): %s", strings.Join(messages, ", "))
+}
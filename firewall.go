@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// firewallRuleName is the name of the rule which lets the client reach the agents of a server.
+// The rule applies to the server through a network tag of the same name as the server.
+func firewallRuleName(instanceName string) string {
+	return instanceName + "-agent"
+}
+
+// getAllowedRanges returns the IP ranges allowed to reach the agents. They are the
+// allowed_cidrs of the serverConfigFile or the public IP of this computer.
+func getAllowedRanges(conf zazabul.Config) ([]string, error) {
+	ranges := make([]string, 0)
+	if conf.Get("allowed_cidrs") != "" {
+		for _, part := range strings.Split(conf.Get("allowed_cidrs"), ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(part); err != nil {
+				return nil, newError(ConfigError, "'%s' in allowed_cidrs is not a CIDR like '203.0.113.0/24'", part)
+			}
+			ranges = append(ranges, part)
+		}
+		sort.Strings(ranges)
+		return ranges, nil
+	}
+
+	resp, err := httpClient.Get(IPCheckURL)
+	if err != nil {
+		return nil, wrapError(ProvisioningError, err, "could not find the public IP of this computer")
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, wrapError(ProvisioningError, err, "could not find the public IP of this computer")
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(raw)))
+	if ip == nil {
+		return nil, newError(ProvisioningError, "could not find the public IP of this computer. Set allowed_cidrs instead.")
+	}
+	if ip.To4() != nil {
+		return []string{ip.String() + "/32"}, nil
+	}
+	return []string{ip.String() + "/128"}, nil
+}
+
+// ensureFirewallRule creates the firewall rule of a server or updates it when the allowed
+// ranges have changed. It also tags servers prepared before the rule existed.
+func ensureFirewallRule(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) error {
+	ranges, err := getAllowedRanges(conf)
+	if err != nil {
+		return err
+	}
+
+	timeouts, _ := getTimeouts(conf)
+	project := conf.Get("project")
+	ruleName := firewallRuleName(instanceName)
+
+	rule, err := computeService.Firewalls.Get(project, ruleName).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		rule = &compute.Firewall{
+			Name:         ruleName,
+			Description:  "Lets cartoons553 reach the agents on " + instanceName,
+			Network:      "global/networks/default",
+			Direction:    "INGRESS",
+			SourceRanges: ranges,
+			TargetTags:   []string{instanceName},
+			Allowed: []*compute.FirewallAllowed{
+				{IPProtocol: "tcp", Ports: []string{"8089"}},
+			},
+		}
+		op, err := computeService.Firewalls.Insert(project, rule).Context(ctx).Do()
+		if err != nil {
+			return wrapError(ProvisioningError, err, "could not create the firewall rule")
+		}
+		err = waitForOperationGlobal(ctx, project, computeService, op, timeouts.Operation)
+		if err != nil {
+			return wrapError(ProvisioningError, err, "could not create the firewall rule")
+		}
+	} else if err != nil {
+		return wrapError(ProvisioningError, err, "could not get the firewall rule")
+	} else {
+		current := append([]string{}, rule.SourceRanges...)
+		sort.Strings(current)
+		if strings.Join(current, ",") != strings.Join(ranges, ",") {
+			fmt.Fprintf(out, "Allowing %s to reach the render server.\n", strings.Join(ranges, ", "))
+			op, err := computeService.Firewalls.Patch(project, ruleName, &compute.Firewall{SourceRanges: ranges}).Context(ctx).Do()
+			if err != nil {
+				return wrapError(ProvisioningError, err, "could not update the firewall rule")
+			}
+			err = waitForOperationGlobal(ctx, project, computeService, op, timeouts.Operation)
+			if err != nil {
+				return wrapError(ProvisioningError, err, "could not update the firewall rule")
+			}
+		}
+	}
+
+	instance, err := computeService.Instances.Get(project, conf.Get("zone"), instanceName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not get the render server's details")
+	}
+	tags := &compute.Tags{}
+	if instance.Tags != nil {
+		tags.Fingerprint = instance.Tags.Fingerprint
+		for _, tag := range instance.Tags.Items {
+			if tag == instanceName {
+				return nil
+			}
+		}
+		tags.Items = append(tags.Items, instance.Tags.Items...)
+	}
+	tags.Items = append(tags.Items, instanceName)
+
+	op, err := computeService.Instances.SetTags(project, conf.Get("zone"), instanceName, tags).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not tag the render server")
+	}
+	err = waitForOperationZone(ctx, project, conf.Get("zone"), computeService, op, timeouts.Operation)
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not tag the render server")
+	}
+
+	return nil
+}
+
+// deleteFirewallRule deletes the firewall rule of a server. A rule which doesn't exist is
+// not an error.
+func deleteFirewallRule(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) error {
+	timeouts, _ := getTimeouts(conf)
+	project := conf.Get("project")
+
+	op, err := computeService.Firewalls.Delete(project, firewallRuleName(instanceName)).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not delete the firewall rule")
+	}
+	err = waitForOperationGlobal(ctx, project, computeService, op, timeouts.Operation)
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not delete the firewall rule")
+	}
+
+	return nil
+}
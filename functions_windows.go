@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -12,30 +14,157 @@ var (
 
 Note: Please try launching your choice server on Google Cloud's website before using it here.
 
-Note: 100 - 200 CPUs is recommended for rendering blender projects.
+Note: Run the bench command to find the machine_type which suits your blender project.
 
 Working Directory: '%s'
-All files must be placed in Working Directory (%s)
+Files given by a relative path are looked for in the Working Directory (%s) and then in
+the current directory. The outputs are saved in the Working Directory.
+It can be changed with the --workdir flag or the C553_WORKDIR environment variable.
 
 Supported Commands:
 
     init    Creates a serverConfigFile for editing. Fill it to your own requirements.
+            It optionally expects the name of the serverConfigFile to create.
+            The fields can be filled with the flags --project, --region, --zone,
+            --machine-type, --sak-file and --quality or with the environment variables
+            C553_PROJECT, C553_REGION, C553_ZONE, C553_MACHINE_TYPE, C553_SAK_FILE and
+            C553_QUALITY.
 
-    prep    Prepares the render server for cartoons553 described in the serverConfigFile. 
-            It would be already configured and kept in a suspended state. 
-						It expects a serverConfigFile gotten from above.
+    prep    Prepares the render server for cartoons553 described in the serverConfigFile.
+            It would be already configured and kept in a suspended state.
+            It expects a serverConfigFile gotten from above.
+            When the zone has no room for the machine_type, the fallback_zones are tried
+            and the zone of the serverConfigFile is changed to where the server ends up.
+            The server and its disks are labelled with app=cartoons553, owner, project,
+            server-config and the labels of the serverConfigFile for the billing reports.
+            It is suspended instead of stopped between renders when the stop_mode of the
+            serverConfigFile is suspend. A suspended server is resumed by the next render.
 
     rnd     Renders a project with the config created above. It expects a blender file and a
             serverConfigFile (created in prep command above)
+            The outputs are saved in a folder named '<time>' in the working directory
+            mirroring the output folder on the server.
+            While rendering, the last rendered frame is saved next to the blender file as
+            '<name>.preview.jpg' every minute.
+            When interrupted with Ctrl-C, it asks to either cancel the render and stop the
+            server or detach from it and leave it rendering.
+            The on_complete or on_failure hook of the serverConfigFile is run once rnd, batch,
+            attach or fetch is over.
+
+    bench   Compares machine types by rendering a few frames of a blender file on each.
+            It expects a blender file and a serverConfigFile. The server is changed to each
+            machine type in turn and back to its machine_type at the end. It reports the
+            seconds and the cost per frame and recommends the cheapest machine type which
+            renders a frame within --target. The frames are '1-3' at 960x540 unless --frames
+            or --resolution are given.
+
+    batch   Renders the shots listed in a batchFile in one session. It expects a batchFile and
+            a serverConfigFile. The server is started once, the outputs of each shot are
+            downloaded to a folder named after the batchFile as soon as the shot is done and
+            the server is stopped at the end. Run it without arguments to print an example
+            batchFile. Shots can bake simulations first and wait for other shots to
+            composite their outputs. The blender files are uploaded directly even with a bucket.
+            When interrupted with Ctrl-C, every shot is cancelled and the server stopped.
+
+    watch   Renders the blender files saved to the working directory until interrupted.
+            It expects a serverConfigFile. A file is rendered once it has been left unchanged
+            for the --debounce duration (10s). Its outputs are put in 'outputs/<file name>/'.
+            The server is started when a file is to be rendered and stopped when every
+            render is done. A file saved again while rendering is rendered again.
+            The on_complete and on_failure hooks are run for every file.
+
+    attach  Continues a render which was detached from. It expects a serverConfigFile
+
+    preview Saves the last rendered frame of a detached render next to its blender file as
+            '<name>.preview.jpg'. It expects a serverConfigFile.
+
+    fetch   Downloads the outputs of a detached render from the bucket once it is done.
+            It expects a serverConfigFile which has a bucket.
+
+    history Lists the prep, render and delete commands run in the working directory with
+            their estimated cost. They are recorded in 'history.jsonl'. The list can be
+            filtered with the flags --since, --until, --command, --status, --server and --blend.
+            For instance 'history --since 7d' lists what was rendered in the last week.
 
     del     Deletes a render server. It expects a serverConfigFile
 
+Flags:
+
+    --json  Prints the result of a command as json and every other message to stderr.
+            Failures are printed as json too. The exit code tells the kind of failure:
+            2 config, 3 auth, 4 quota, 5 provisioning, 6 agent, 7 render and 130 interrupted.
+
+    --detach
+            Makes rnd leave the server rendering once the render has begun.
+
+    --workdir
+            The Working Directory to use instead of the default one.
+
+    --overwrite
+            Replaces outputs which already exist instead of skipping them.
+
+    --archive
+            Downloads the outputs of rnd and batch from the server as a single archive.
+            It is quicker for many small outputs like image sequences but can't be resumed.
+
+    --debounce
+            How long watch waits after a blender file changes before rendering it.
+
+    --scenes, --cameras, --view-layers
+            The scenes, cameras and view layers rnd renders, separated by commas. Every
+            combination is rendered to its own folder like 'Scene/Camera/'. A camera can also
+            be a timeline marker bound to a camera. The active ones are used when not given.
+
+    --frames
+            The frames rnd renders: a range like '1-120' or a list like '1,5,10..20'.
+
+    --still
+            Makes rnd render the --frames as images like posters instead of an animation.
+            The images are PNG unless --format is given.
+
+    --format
+            The output format of rnd like AVIJPEG, FFMPEG, PNG, TIFF or OPEN_EXR. It is case
+            insensitive and EXR, JPG and TIF can be used for OPEN_EXR, JPEG and TIFF.
+
+    --resolution
+            The size of the outputs of rnd like '3840x2160'.
+
+    --since, --until
+            The time the history begins and ends: a date like '2024-05-01' or a duration
+            before now like '7d' or '12h'.
+
+    --command, --status, --server, --blend
+            Lists the history of a command (rnd), a status (done, failed, cancelled or
+            detached), a render server or the blender files whose names have the text given.
+
+    --machine-type
+            The machine type rnd renders with instead of the machine_type of the
+            serverConfigFile like 'c2d-highcpu-112'. The server keeps it after the render
+            unless --restore-machine-type is given.
+
+    --restore-machine-type
+            Changes the server back to the machine type it had before rnd.
+
+    --move-zone
+            Moves a server which can't start because its zone has no room for it to one of
+            the fallback_zones without asking. Its data disk starts empty.
+
+    --machine-types
+            The machine types bench compares separated by commas. The machine_type of the
+            serverConfigFile and some e2 and n2 highcpu machines are compared when not given.
+
+    --target
+            The longest bench allows a frame to take like '30s'.
+
+    --on-interrupt
+            What rnd and attach do when interrupted without asking: 'cancel' or 'detach'.
+
 `
 )
 
 func hasUpdate() bool {
 	outPath := filepath.Join(os.TempDir(), "c553.txt")
-	err := downloadFile(UpdateURLCheck, outPath)
+	err := downloadFile(context.Background(), transferClient, UpdateURLCheck, outPath, OverwriteExisting)
 	if err != nil {
 		fmt.Println(err)
 		return false
@@ -53,3 +182,8 @@ func hasUpdate() bool {
 
 	return false
 }
+
+// shellCommand runs command with the shell of the system.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
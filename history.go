@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+)
+
+// historyFileName is the ledger of the commands run in a working directory. It is a json
+// record per line which is only ever appended to.
+const historyFileName = "history.jsonl"
+
+// HistoryRecord is a prep, render or delete in the history ledger.
+type HistoryRecord struct {
+	Command     string          `json:"command"`
+	Config      string          `json:"config,omitempty"`
+	Server      string          `json:"server,omitempty"`
+	MachineType string          `json:"machine_type,omitempty"`
+	Job         string          `json:"job,omitempty"`
+	Blend       string          `json:"blend,omitempty"`
+	BlendSHA256 string          `json:"blend_sha256,omitempty"`
+	Settings    *RenderSettings `json:"settings,omitempty"`
+	Start       time.Time       `json:"start"`
+	End         time.Time       `json:"end"`
+	// Status is done, failed, cancelled or detached.
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	OutputPath string  `json:"output_path,omitempty"`
+	Cost       float64 `json:"estimated_cost_usd"`
+}
+
+// commandSession is a command which changes or renders on a server. Once it is over, it is
+// recorded in the history and renders run the hooks of their serverConfigFile.
+type commandSession struct {
+	command     string
+	configPath  string
+	blenderPath string
+	// job names the render when the command doesn't, like the batchFile of batch.
+	job       string
+	beginTime time.Time
+	// conf is read when the command begins as del removes its serverConfigFile.
+	conf    zazabul.Config
+	hasConf bool
+}
+
+// renderCommands are the commands which run hooks.
+var renderCommands = map[string]bool{"rnd": true, "batch": true, "attach": true, "fetch": true}
+
+func beginSession(command, configPath, blenderPath string) *commandSession {
+	session := &commandSession{command: command, configPath: configPath, blenderPath: blenderPath,
+		beginTime: time.Now()}
+	conf, err := zazabul.LoadConfigFile(configPath)
+	if err == nil {
+		session.conf, session.hasConf = conf, true
+	}
+	return session
+}
+
+// end records the outcome of the command and runs its hook. Renders which are not done yet
+// are not recorded.
+func (session *commandSession) end(result *CommandResult, err error) {
+	if session == nil {
+		return
+	}
+	if result != nil && result.Pending {
+		return
+	}
+
+	record := &HistoryRecord{
+		Command: session.command,
+		Config:  session.configPath,
+		Blend:   session.blenderPath,
+		Job:     session.job,
+		Start:   session.beginTime,
+		End:     time.Now(),
+		Status:  "done",
+	}
+	if session.hasConf {
+		record.Server = session.conf.Get("name")
+		record.MachineType = session.conf.Get("machine_type")
+	}
+	if result != nil {
+		record.Server = firstNonEmpty(result.Instance, record.Server)
+		record.Job = firstNonEmpty(result.Job, record.Job)
+		record.Blend = firstNonEmpty(result.BlenderPath, record.Blend)
+		record.BlendSHA256 = result.BlenderSHA256
+		record.Settings = result.Settings
+		record.MachineType = firstNonEmpty(result.MachineType, record.MachineType)
+		record.OutputPath = result.OutputPath
+		record.Cost = result.EstimatedCost
+		// attach and fetch continue renders which began earlier.
+		if result.Duration > 0 {
+			record.Start = record.End.Add(-time.Duration(result.Duration * float64(time.Second)))
+		}
+		if result.Detached {
+			record.Status = "detached"
+		}
+	}
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) && c553Err.Kind == InterruptError {
+		record.Status, record.Error = "cancelled", err.Error()
+	} else if err != nil {
+		record.Status, record.Error = "failed", err.Error()
+	}
+	if record.BlendSHA256 == "" && record.Blend != "" {
+		_, record.BlendSHA256, _ = fileSHA256(record.Blend)
+	}
+
+	appendHistory(record)
+
+	if session.hasConf && renderCommands[session.command] {
+		event := newHookEvent(session.command, session.blenderPath, session.beginTime, result, err)
+		if event != nil {
+			event.Job = firstNonEmpty(event.Job, session.job)
+			runHook(session.conf, event)
+		}
+	}
+}
+
+// appendHistory adds a record to the ledger. A ledger which can't be written is reported
+// but doesn't fail the command.
+func appendHistory(record *HistoryRecord) {
+	rootPath, _ := GetRootPath()
+	raw, err := json.Marshal(record)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(rootPath, historyFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err == nil {
+			_, err = f.Write(append(raw, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(out, color.Red.Sprintf("could not record the %s command in the history: %s", record.Command, err))
+	}
+}
+
+// HistoryFilter picks records of the history. Empty fields match every record.
+type HistoryFilter struct {
+	Since   time.Time
+	Until   time.Time
+	Command string
+	Status  string
+	Server  string
+	// Blend matches the records whose blender file has it in its name.
+	Blend string
+}
+
+func (filter HistoryFilter) matches(record HistoryRecord) bool {
+	if !filter.Since.IsZero() && record.Start.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !record.Start.Before(filter.Until) {
+		return false
+	}
+	if filter.Command != "" && record.Command != filter.Command {
+		return false
+	}
+	if filter.Status != "" && record.Status != filter.Status {
+		return false
+	}
+	if filter.Server != "" && record.Server != filter.Server {
+		return false
+	}
+	if filter.Blend != "" && !strings.Contains(filepath.Base(record.Blend), filter.Blend) {
+		return false
+	}
+	return true
+}
+
+// parseHistoryTime reads the --since and --until flags. They are either dates like
+// '2024-05-01' or durations before now like '7d' or '12h'.
+func parseHistoryTime(value string) (time.Time, error) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return time.Time{}, newError(ConfigError, "'%s' is not a date like '2024-05-01' or a duration like '7d'", value)
+	}
+	return time.Now().Add(-duration), nil
+}
+
+// readHistory returns the records of the ledger which match filter in the order they were
+// recorded. Lines which can't be read are skipped.
+func readHistory(filter HistoryFilter) ([]HistoryRecord, error) {
+	rootPath, _ := GetRootPath()
+	records := make([]HistoryRecord, 0)
+	f, err := os.Open(filepath.Join(rootPath, historyFileName))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the history")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record HistoryRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the history")
+	}
+	return records, nil
+}
+
+// doHistory lists the records of the history which match filter with their total cost.
+func doHistory(filter HistoryFilter) (*CommandResult, error) {
+	records, err := readHistory(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0.0
+	for _, record := range records {
+		total += record.Cost
+		name := filepath.Base(record.Blend)
+		if record.Blend == "" {
+			name = record.Job
+		}
+		line := fmt.Sprintf("%s  %-6s  %-9s  %-20s  %-24s  %10s  $%.2f",
+			record.Start.Local().Format("2006-01-02 15:04"), record.Command, record.Status, record.Server, name,
+			record.End.Sub(record.Start).Round(time.Second).String(), record.Cost)
+		if record.OutputPath != "" {
+			line += "  " + record.OutputPath
+		}
+		if record.Status == "failed" || record.Status == "cancelled" {
+			line = color.Red.Sprint(line)
+		}
+		fmt.Fprintln(out, line)
+	}
+	fmt.Fprintf(out, "%d records. Estimated cost: $%.2f\n", len(records), total)
+
+	return &CommandResult{
+		Command:       "history",
+		EstimatedCost: total,
+		History:       records,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+)
+
+// hookTimeout limits how long a hook may take. A hook which fails or times out is reported
+// but doesn't change the outcome of the command.
+const hookTimeout = 10 * time.Minute
+
+// HookEvent is what the on_complete and on_failure hooks of a serverConfigFile are told
+// about a render. Webhooks get it as json and commands as environment variables.
+type HookEvent struct {
+	Command    string  `json:"command"`
+	Job        string  `json:"job,omitempty"`
+	Blend      string  `json:"blend,omitempty"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Duration   float64 `json:"duration_seconds"`
+	Cost       float64 `json:"estimated_cost_usd"`
+	OutputPath string  `json:"output_path,omitempty"`
+}
+
+// newHookEvent describes the outcome of a command. Renders which were detached from or
+// are not done yet have no outcome and give nil.
+func newHookEvent(command, blenderPath string, beginTime time.Time, result *CommandResult, err error) *HookEvent {
+	event := &HookEvent{Command: command, Blend: blenderPath, Status: "done"}
+	if result != nil {
+		if result.Detached || result.Pending {
+			return nil
+		}
+		event.Job = result.Job
+		if result.BlenderPath != "" {
+			event.Blend = result.BlenderPath
+		}
+		event.Duration = result.Duration
+		event.Cost = result.EstimatedCost
+		event.OutputPath = result.OutputPath
+	} else {
+		event.Duration = time.Since(beginTime).Seconds()
+	}
+
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) && c553Err.Kind == InterruptError {
+		event.Status, event.Error = "cancelled", err.Error()
+	} else if err != nil {
+		event.Status, event.Error = "failed", err.Error()
+	}
+	return event
+}
+
+// runHook runs the on_complete hook of conf for renders which are done and the on_failure
+// hook for the others. A hook is either a webhook URL or a shell command.
+func runHook(conf zazabul.Config, event *HookEvent) {
+	hook := conf.Get("on_complete")
+	if event.Status != "done" {
+		hook = conf.Get("on_failure")
+	}
+	hook = strings.TrimSpace(hook)
+	if hook == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var err error
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = postWebhook(ctx, hook, event)
+	} else {
+		err = runHookCommand(ctx, hook, event)
+	}
+	if err != nil {
+		fmt.Fprintln(out, color.Red.Sprintf("The hook of the %s command failed: %s", event.Command, err))
+	}
+}
+
+// postWebhook sends event as json to a webhook URL.
+func postWebhook(ctx context.Context, hookURL string, event *HookEvent) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", hookURL, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runHookCommand runs a shell command in the working directory with event in its
+// environment as C553_COMMAND, C553_JOB, C553_BLEND, C553_STATUS, C553_ERROR,
+// C553_DURATION, C553_COST and C553_OUTPUT_PATH.
+func runHookCommand(ctx context.Context, command string, event *HookEvent) error {
+	rootPath, _ := GetRootPath()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Dir = rootPath
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"C553_COMMAND="+event.Command,
+		"C553_JOB="+event.Job,
+		"C553_BLEND="+event.Blend,
+		"C553_STATUS="+event.Status,
+		"C553_ERROR="+event.Error,
+		fmt.Sprintf("C553_DURATION=%.0f", event.Duration),
+		fmt.Sprintf("C553_COST=%.2f", event.Cost),
+		"C553_OUTPUT_PATH="+event.OutputPath,
+	)
+	return cmd.Run()
+}
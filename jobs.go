@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// DetachedJob is a render which was left running on its server. It is saved so that the
+// attach command can continue it.
+type DetachedJob struct {
+	Instance    string `json:"instance"`
+	BlenderPath string `json:"blender_path"`
+	// BlenderSHA256 is the checksum of the blender file when the render began.
+	BlenderSHA256 string         `json:"blender_sha256,omitempty"`
+	Settings      RenderSettings `json:"settings"`
+	// MachineType is the machine type the server renders with. The server is changed to
+	// RestoreMachineType when stopped if it is set.
+	MachineType        string `json:"machine_type,omitempty"`
+	RestoreMachineType string `json:"restore_machine_type,omitempty"`
+	// JobID is the ID of the render in the queue of the agents.
+	JobID      string    `json:"job_id"`
+	BeginTime  time.Time `json:"begin_time"`
+	RenderTime time.Time `json:"render_time"`
+
+	// Bucket and Prefix are where the files of the render are staged when the serverConfigFile
+	// has a bucket.
+	Bucket string `json:"bucket,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// detachedJobPath is where the detached job of a server is saved. A server renders one
+// job at a time so the path is derived from its serverConfigFile.
+func detachedJobPath(rootPath, serverConfigPath string) string {
+	return filepath.Join(rootPath, "jobs", filepath.Base(serverConfigPath)+".json")
+}
+
+func saveDetachedJob(rootPath, serverConfigPath string, job *DetachedJob) error {
+	jobPath := detachedJobPath(rootPath, serverConfigPath)
+	os.MkdirAll(filepath.Dir(jobPath), 0777)
+
+	raw, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return wrapError(ConfigError, err, "could not save the detached render")
+	}
+	err = os.WriteFile(jobPath, raw, 0777)
+	if err != nil {
+		return wrapError(ConfigError, err, "could not save the detached render")
+	}
+
+	return nil
+}
+
+func loadDetachedJob(rootPath, serverConfigPath string) (*DetachedJob, error) {
+	raw, err := os.ReadFile(detachedJobPath(rootPath, serverConfigPath))
+	if os.IsNotExist(err) {
+		return nil, newError(ConfigError, "There is no detached render for '%s'", filepath.Base(serverConfigPath))
+	}
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the detached render")
+	}
+
+	job := &DetachedJob{}
+	err = json.Unmarshal(raw, job)
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not read the detached render")
+	}
+
+	return job, nil
+}
+
+func removeDetachedJob(rootPath, serverConfigPath string) {
+	os.RemoveAll(detachedJobPath(rootPath, serverConfigPath))
+}
+
+// doAttach continues following a render which was detached from.
+func doAttach(ctx context.Context, serverConfigPath string, opts RenderOptions) (*CommandResult, error) {
+	rootPath, _ := GetRootPath()
+
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	job, err := loadDetachedJob(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var storageService *storage.Service
+	if job.Bucket != "" {
+		storageService, err = newStorageService(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), job.Instance).Context(ctx).Do()
+	if err != nil {
+		return nil, wrapError(ProvisioningError, err, "could not get the render server's details")
+	}
+
+	// a server rendering to a bucket stops itself when done. Its outputs are then in the bucket.
+	// A render which was suspended with its server goes on once the server is resumed.
+	var agent *Agent
+	if instance.Status == "SUSPENDED" {
+		agent, err = startServer(ctx, computeService, conf, serverConfigPath, job.Instance)
+		if err != nil {
+			return nil, err
+		}
+	} else if instance.Status == "RUNNING" {
+		err = ensureFirewallRule(ctx, computeService, conf, job.Instance)
+		if err != nil {
+			return nil, err
+		}
+
+		timeouts, _ := getTimeouts(conf)
+		agent, err = connectAgent(ctx, computeService, conf, job.Instance, timeouts.Boot)
+		if err == errTimedOut {
+			err = timeoutError(AgentError, "connecting to the render server's agents", timeouts.Boot)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if job.Bucket == "" {
+		removeDetachedJob(rootPath, serverConfigPath)
+		return nil, newError(ProvisioningError, "The render server is no longer running (status: %s)", instance.Status)
+	}
+
+	fmt.Fprintf(out, "Attached to the render of '%s'\n", job.BlenderPath)
+	result, err := followRender(ctx, serverConfigPath, conf, computeService, storageService, agent, job, opts)
+	if result != nil {
+		result.Command = "attach"
+	}
+	return result, err
+}
+
+// doFetch downloads the outputs of a detached render from the bucket if it is done.
+// It does not need the render server to be running.
+func doFetch(ctx context.Context, serverConfigPath string) (*CommandResult, error) {
+	rootPath, _ := GetRootPath()
+
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	job, err := loadDetachedJob(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if job.Bucket == "" {
+		return nil, newError(ConfigError, "The detached render does not use a bucket. Run the attach command instead.")
+	}
+
+	storageService, err := newStorageService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	// a render which finished without being done fails in followRender which stops its server.
+	done, err := isStagedRenderDone(ctx, storageService, job.Bucket, job.Prefix)
+	if err != nil && !done {
+		return nil, err
+	}
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !done {
+		fmt.Fprintf(out, "The render of '%s' is not done yet. It has been rendering for %s.\n", job.BlenderPath,
+			time.Since(job.RenderTime).Round(time.Second).String())
+		instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), job.Instance).Context(ctx).Do()
+		if err == nil && instance.Status == "SUSPENDED" {
+			fmt.Fprintf(out, "The render server is suspended. Run 'attach %s' to resume it.\n", filepath.Base(serverConfigPath))
+		}
+		return &CommandResult{
+			Command:    "fetch",
+			Instance:   job.Instance,
+			ConfigPath: serverConfigPath,
+			Pending:    true,
+		}, nil
+	}
+
+	result, err := followRender(ctx, serverConfigPath, conf, computeService, storageService, nil, job, RenderOptions{})
+	if result != nil {
+		result.Command = "fetch"
+	}
+	return result, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// labelKeyRegexp is what Google Cloud allows as a label key. Values are the same but may
+// also be empty or begin with a digit, a dash or an underscore.
+var labelKeyRegexp = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// labelValue makes value fit for a label value: lowercase letters, digits, dashes and
+// underscores up to 63 characters. Other characters are replaced with dashes.
+func labelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.TrimSpace(value)))
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return value
+}
+
+// parseLabels reads the labels field of a serverConfigFile: 'key=value' pairs separated by
+// commas.
+func parseLabels(raw string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !labelKeyRegexp.MatchString(key) {
+			return nil, newError(ConfigError, "The label '%s' is not valid. A label key begins with a lowercase "+
+				"letter and has only lowercase letters, digits, dashes and underscores.", key)
+		}
+		labels[key] = labelValue(value)
+	}
+	return labels, nil
+}
+
+// serverLabels are the labels of a server and its disks so that its cost can be told apart
+// in the billing reports: app, owner, project when project_tag is set and server-config
+// along with the labels of the serverConfigFile. The owner is the user of this computer
+// unless the owner field is set.
+func serverLabels(conf zazabul.Config, serverConfigPath string) (map[string]string, error) {
+	labels, err := parseLabels(conf.Get("labels"))
+	if err != nil {
+		return nil, err
+	}
+
+	owner := conf.Get("owner")
+	if owner == "" {
+		if current, err := user.Current(); err == nil {
+			owner = filepath.Base(filepath.ToSlash(current.Username))
+		}
+	}
+	labels["app"] = "cartoons553"
+	labels["owner"] = labelValue(owner)
+	if conf.Get("project_tag") != "" {
+		labels["project"] = labelValue(conf.Get("project_tag"))
+	}
+	name := filepath.Base(serverConfigPath)
+	labels["server-config"] = labelValue(strings.TrimSuffix(name, filepath.Ext(name)))
+	return labels, nil
+}
+
+// setLastJobLabel sets the last-job label of a server to the name of the blender file it
+// renders.
+func setLastJobLabel(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName,
+	blenderPath string) error {
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, interruptedOr(ctx, err), "could not get the render server's details")
+	}
+
+	labels := make(map[string]string)
+	for key, value := range instance.Labels {
+		labels[key] = value
+	}
+	name := filepath.Base(blenderPath)
+	labels["last-job"] = labelValue(strings.TrimSuffix(name, filepath.Ext(name)))
+	req := &compute.InstancesSetLabelsRequest{Labels: labels, LabelFingerprint: instance.LabelFingerprint}
+	_, err = computeService.Instances.SetLabels(conf.Get("project"), conf.Get("zone"), instanceName, req).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, interruptedOr(ctx, err), "could not label the render server")
+	}
+	return nil
+}
@@ -1,21 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gookit/color"
 	"github.com/saenuma/zazabul"
 )
 
 const (
 	VersionFormat  = "20060102T150405MST"
-	AppVersion     = "13"
+	AppVersion     = "14"
 	UpdateURLCheck = "https://sae.ng/static/c553/c553.txt"
+	IPCheckURL     = "https://api.ipify.org"
 
 	tmpl = `// project is the Google Cloud Project name
 // It can be created either from the Google Cloud Console or from the gcloud command
@@ -30,6 +34,11 @@ region:
 // for instance a region could be 'us-central1' and the zone could be 'us-central1-a'
 zone:
 
+// fallback_zones are the zones tried in order when the zone above has no room for the machine_type,
+// separated by commas. 'any' means every other zone of the region. If left empty, only the zone is used.
+// The zone above is changed to where the server ends up.
+fallback_zones:
+
 
 // machine_type is the type of machine configuration to use render your blender project.
 // Get the machine_type from https://cloud.google.com/compute/all-pricing and its costs.
@@ -39,10 +48,32 @@ zone:
 machine_type: e2-highcpu-4
 
 
+// stop_mode is what is done to the server after a render: 'stop' or 'suspend' (stop).
+// A suspended server keeps its memory so the next render begins without booting it and Blender,
+// its caches and the jobs on the server are kept. Suspended servers cost their memory and disks.
+// Servers with a GPU or more than 208 GB of memory can't be suspended and are stopped.
+// With a bucket and suspend, the server doesn't stop itself after a render. It is suspended when the
+// outputs are fetched.
+stop_mode:
+
+
+// disk_size_gb is the size in GB of the disk of the server (10).
+// Without a data disk, it holds the system and blender as well as the blender files and the outputs.
+disk_size_gb:
+
+// disk_type is the type of the disks of the server like pd-balanced or pd-ssd (pd-ssd).
+disk_type:
+
+// data_disk_size_gb is the size in GB of an optional second disk for the blender files and the outputs.
+// Use one for long PNG or EXR sequences. If left empty, there is no second disk.
+// The disks are set by the prep command so a prepared server keeps its disks.
+data_disk_size_gb:
+
+
 // sak means service account key file.
 // sak_file is a key gotten from https://console.cloud.google.com .
 // It is necessary to connect to an instance.
-// It must be placed in the path where this config is.
+// A relative path is looked for next to this config and then in the working directory.
 sak_file:
 
 // the quality metric here specifies the render engine to use.
@@ -50,11 +81,86 @@ sak_file:
 // if the quality is low it would use the EEVEE render engine.
 quality: low
 
+
+// allowed_cidrs are the IP ranges allowed to reach the render server, separated by commas.
+// for instance '203.0.113.0/24, 198.51.100.7/32'
+// If left empty, only the public IP of the computer running cartoons553 is allowed.
+// The public IP is checked on every render.
+allowed_cidrs:
+
+
+// bucket is an optional Cloud Storage bucket to stage the blender file and the outputs in.
+// With a bucket, the render server gets the blender file from the bucket, puts the outputs in it
+// and stops itself when done. So you can detach from a render and fetch the outputs later.
+// The default service account of the render server must be allowed to read and write objects in the
+// bucket (Storage Object User) as the server uses it. So must the sak_file as cartoons553 uploads the
+// blender file and downloads the outputs with it.
+bucket:
+
+
+// vcpu_hour_cost and gb_hour_cost are used to estimate the cost of your renders in US dollars.
+// They are the price of one vCPU for an hour and one GB of memory for an hour of your machine_type.
+// Get them from https://cloud.google.com/compute/all-pricing .
+// If left empty, the prices of e2 machines in us-central1 are used.
+vcpu_hour_cost:
+
+gb_hour_cost:
+
+
+// The timeouts below limit how long each phase may take before cartoons553 gives up.
+// A server which is being prepared is then deleted and a server which is rendering is stopped.
+// They are durations like '45m' or '2h'. If left empty, the default in brackets is used.
+// operation_timeout is for creating, starting, stopping and deleting the server (10m).
+operation_timeout:
+
+// boot_timeout is for the server to be ready after it is started (10m).
+boot_timeout:
+
+// provisioning_timeout is for the server to be configured by the prep command (45m).
+provisioning_timeout:
+
+// upload_timeout is for uploading the blender file (30m).
+upload_timeout:
+
+// render_timeout is for the render to finish (12h).
+render_timeout:
+
+
+// The render server and its disks are labelled so that their cost can be told apart in the billing
+// reports. They get app=cartoons553, owner, project when project_tag is set, server-config with
+// the name of this file and last-job with the name of the last blender file rendered.
+// owner is who the cost is for. If left empty, it is the user of this computer.
+owner:
+
+// project_tag is the project the renders are for like 'spring-ad'.
+project_tag:
+
+// labels are more labels like 'team=animation, client=acme' separated by commas.
+labels:
+
+
+// on_complete and on_failure are run when a render is done or has failed.
+// Each is either a webhook URL which is sent the render as json or a shell command run in
+// the working directory with the render in the environment variables C553_COMMAND, C553_JOB,
+// C553_BLEND, C553_STATUS, C553_ERROR, C553_DURATION, C553_COST and C553_OUTPUT_PATH.
+// They are run by cartoons553 so detached renders run them when attached to or fetched.
+on_complete:
+
+on_failure:
+
 	`
 )
 
 func main() {
-	if runtime.GOOS == "windows" {
+	positional, flags := parseArgs(os.Args[1:])
+	if _, ok := flags["json"]; ok {
+		setJSONMode()
+	}
+	if _, ok := flags["help"]; ok {
+		positional = append([]string{"help"}, positional...)
+	}
+
+	if runtime.GOOS == "windows" && !jsonMode {
 		if hasUpdate() {
 			fmt.Println("cartoons553 has an update")
 			fmt.Println("Go to https://sae.ng and download again.")
@@ -62,94 +168,299 @@ func main() {
 		}
 	}
 
-	if len(os.Args) < 2 {
-		color.Red.Println("Expecting a command. Run with help subcommand to view help.")
-		os.Exit(1)
+	if len(positional) < 1 {
+		exitWithError(newError(ConfigError, "Expecting a command. Run with help subcommand to view help."))
 	}
 
+	command, args := positional[0], positional[1:]
+	if err := checkFlags(command, flags); err != nil {
+		exitWithError(err)
+	}
+
+	workdir = flags["workdir"]
+	_, moveZone = flags["move-zone"]
 	rootPath, err := GetRootPath()
 	if err != nil {
-		color.Red.Println(err.Error())
-		os.Exit(1)
+		exitWithError(err)
+	}
+
+	// the first Ctrl-C is handled by the commands, a second one kills the cli.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	_, detach := flags["detach"]
+	renderOpts := RenderOptions{Detach: detach, OnInterrupt: flags["on-interrupt"]}
+	if _, ok := flags["overwrite"]; ok {
+		renderOpts.ExistsPolicy = OverwriteExisting
 	}
+	_, renderOpts.Archive = flags["archive"]
+	renderOpts.MachineType = flags["machine-type"]
+	_, renderOpts.RestoreMachineType = flags["restore-machine-type"]
+	_, still := flags["still"]
+	renderOpts.Settings = RenderSettings{
+		Scenes:     splitNames(flags["scenes"]),
+		Cameras:    splitNames(flags["cameras"]),
+		ViewLayers: splitNames(flags["view-layers"]),
+		Frames:     flags["frames"],
+		Format:     parseFormat(flags["format"]),
+		Resolution: flags["resolution"],
+		Still:      still,
+	}
+	if err := renderOpts.Settings.validate(); err != nil {
+		exitWithError(err)
+	}
+	if renderOpts.OnInterrupt != "" && renderOpts.OnInterrupt != "cancel" && renderOpts.OnInterrupt != "detach" {
+		exitWithError(newError(ConfigError, "The --on-interrupt flag expects 'cancel' or 'detach'"))
+	}
+
+	var result *CommandResult
+	// commands which change or render on a server are recorded in the history.
+	var session *commandSession
 
-	switch os.Args[1] {
-	case "--help", "help", "h":
+	switch command {
+	case "help", "h":
 		fmt.Printf(HelpMessage, rootPath, rootPath)
 
 	case "init":
-		if runtime.GOOS != "windows" {
-			return
+		if len(args) > 1 {
+			exitWithError(usageError(command, "The init command expects at most a serverConfigFile"))
 		}
-
 		configFileName := "s" + time.Now().Format(VersionFormat) + ".zconf"
-		confPath := filepath.Join(rootPath, configFileName)
-		os.WriteFile(confPath, []byte(tmpl), 0777)
-		fmt.Printf("Edit '%s' to your requirements.\n", confPath)
+		if len(args) == 1 {
+			configFileName = args[0]
+		}
+
+		confPath, err := writeInitConfig(getConfigPath(rootPath, configFileName), flags)
+		if err != nil {
+			exitWithError(wrapError(ConfigError, err, "could not create the serverConfigFile"))
+		}
+		fmt.Fprintf(out, "Edit '%s' to your requirements.\n", confPath)
+		result = &CommandResult{Command: "init", ConfigPath: confPath}
 
 	case "prep":
-		if runtime.GOOS == "linux" {
-			configFileName := "s" + time.Now().Format(VersionFormat) + ".zconf"
-			confPath := filepath.Join(rootPath, configFileName)
+		if len(args) > 1 {
+			exitWithError(usageError(command, "The prep command expects at most a serverConfigFile"))
+		}
+		if len(args) == 1 {
+			session = beginSession(command, getConfigPath(rootPath, args[0]), "")
+			result, err = doPrep(ctx, getConfigPath(rootPath, args[0]))
+			break
+		}
 
-			conf, err := zazabul.ParseConfig(tmpl)
-			if err != nil {
-				panic(err)
-			}
+		if runtime.GOOS != "linux" {
+			exitWithError(usageError(command, "Expects a confPath gotten from the init command"))
+		}
 
-			err = conf.Write(confPath)
-			if err != nil {
-				panic(err)
-			}
+		configFileName := "s" + time.Now().Format(VersionFormat) + ".zconf"
+		var confPath string
+		confPath, err = writeInitConfig(filepath.Join(rootPath, configFileName), map[string]string{})
+		if err != nil {
+			exitWithError(wrapError(ConfigError, err, "could not create the serverConfigFile"))
+		}
+
+		cmd := exec.Command("nano", confPath)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			exitWithError(err)
+		}
+
+		session = beginSession(command, confPath, "")
+		result, err = doPrep(ctx, confPath)
+
+	case "rnd":
+		if len(args) != 2 {
+			exitWithError(usageError(command, "The rnd command expects a blender file and a serverConfigFile"))
+		}
+
+		blenderPath := getConfigPath(rootPath, args[0])
+		if !DoesPathExists(blenderPath) {
+			exitWithError(newError(ConfigError, "The file '%s' does not exist in '%s' or the current directory", args[0],
+				rootPath))
+		}
 
-			cmd := exec.Command("nano", confPath)
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				color.Red.Println(err.Error())
-				os.Exit(1)
+		serverConfigPath := getConfigPath(rootPath, args[1])
+		session = beginSession(command, serverConfigPath, blenderPath)
+		result, err = doRender(ctx, blenderPath, serverConfigPath, renderOpts)
+
+	case "bench":
+		if len(args) != 2 {
+			exitWithError(usageError(command, "The bench command expects a blender file and a serverConfigFile"))
+		}
+		blenderPath := getConfigPath(rootPath, args[0])
+		if !DoesPathExists(blenderPath) {
+			exitWithError(newError(ConfigError, "The file '%s' does not exist in '%s' or the current directory", args[0],
+				rootPath))
+		}
+		benchOpts := BenchOptions{Settings: renderOpts.Settings}
+		if flags["machine-types"] != "" {
+			benchOpts.MachineTypes = strings.Split(flags["machine-types"], ",")
+		}
+		if flags["target"] != "" {
+			benchOpts.Target, err = time.ParseDuration(flags["target"])
+			if err != nil || benchOpts.Target <= 0 {
+				exitWithError(newError(ConfigError, "The --target flag expects a duration like '30s'"))
 			}
+		}
+
+		serverConfigPath := getConfigPath(rootPath, args[1])
+		session = beginSession(command, serverConfigPath, blenderPath)
+		result, err = doBench(ctx, blenderPath, serverConfigPath, benchOpts)
+
+	case "batch":
+		if len(args) == 0 {
+			fmt.Print(batchTmpl)
+			break
+		}
+		if len(args) != 2 {
+			exitWithError(usageError(command, "The batch command expects a batchFile and a serverConfigFile"))
+		}
 
-			doPrep(confPath)
+		session = beginSession(command, getConfigPath(rootPath, args[1]), "")
+		session.job = args[0]
+		result, err = doBatch(ctx, getConfigPath(rootPath, args[0]), session.configPath, renderOpts)
 
-		} else if runtime.GOOS == "windows" {
-			if len(os.Args) != 3 {
-				color.Red.Println("Expects a confPath gotten from the init command")
-				os.Exit(1)
+	case "watch":
+		if len(args) != 1 {
+			exitWithError(usageError(command, "The watch command expects a serverConfigFile"))
+		}
+		debounce := defaultDebounce
+		if flags["debounce"] != "" {
+			debounce, err = time.ParseDuration(flags["debounce"])
+			if err != nil || debounce <= 0 {
+				exitWithError(newError(ConfigError, "The --debounce flag expects a duration like '10s'"))
 			}
+		}
 
-			confPath := os.Args[2]
-			doPrep(confPath)
+		session = beginSession(command, getConfigPath(rootPath, args[0]), "")
+		result, err = doWatch(ctx, session.configPath, debounce)
+
+	case "attach":
+		if len(args) != 1 {
+			exitWithError(usageError(command, "The attach command expects a serverConfigFile"))
 		}
 
-	case "rnd":
-		if len(os.Args) != 4 {
-			color.Red.Println("The rnd command expects a blender file and a serverConfigFile")
-			os.Exit(1)
+		serverConfigPath := getConfigPath(rootPath, args[0])
+		session = beginSession(command, serverConfigPath, "")
+		result, err = doAttach(ctx, serverConfigPath, renderOpts)
+
+	case "preview":
+		if len(args) != 1 {
+			exitWithError(usageError(command, "The preview command expects a serverConfigFile"))
 		}
 
-		blenderPath := filepath.Join(rootPath, os.Args[2])
-		if !DoesPathExists(blenderPath) {
-			color.Red.Printf("The file '%s' does not exist in '%s'", os.Args[2], rootPath)
-			os.Exit(1)
+		result, err = doPreview(ctx, getConfigPath(rootPath, args[0]))
+
+	case "fetch":
+		if len(args) != 1 {
+			exitWithError(usageError(command, "The fetch command expects a serverConfigFile"))
+		}
+
+		serverConfigPath := getConfigPath(rootPath, args[0])
+		session = beginSession(command, serverConfigPath, "")
+		result, err = doFetch(ctx, serverConfigPath)
+
+	case "history":
+		if len(args) != 0 {
+			exitWithError(usageError(command, "The history command expects no arguments"))
+		}
+		filter := HistoryFilter{Command: flags["command"], Status: flags["status"], Server: flags["server"],
+			Blend: flags["blend"]}
+		if flags["since"] != "" {
+			filter.Since, err = parseHistoryTime(flags["since"])
+		}
+		if err == nil && flags["until"] != "" {
+			filter.Until, err = parseHistoryTime(flags["until"])
+		}
+		if err != nil {
+			exitWithError(err)
 		}
 
-		serverConfigPath := filepath.Join(rootPath, os.Args[3])
-		doRender(blenderPath, serverConfigPath)
+		result, err = doHistory(filter)
 
 	case "del":
-		if len(os.Args) != 3 {
-			color.Red.Println("The del command expects a serverConfigFile")
-			os.Exit(1)
+		if len(args) != 1 {
+			exitWithError(usageError(command, "The del command expects a serverConfigFile"))
 		}
 
-		serverConfigPath := filepath.Join(rootPath, os.Args[2])
-		doDelete(serverConfigPath)
+		serverConfigPath := getConfigPath(rootPath, args[0])
+		session = beginSession(command, serverConfigPath, "")
+		result, err = doDelete(ctx, serverConfigPath)
 
 	default:
-		color.Red.Println("Unexpected command. Run the cli with --help to find out the supported commands.")
-		os.Exit(1)
+		exitWithError(newError(ConfigError, "Unexpected command. Run the cli with --help to find out the supported commands."))
+	}
+
+	session.end(result, err)
+
+	if err != nil {
+		exitWithResult(result, err)
+	}
+	printResult(result)
+}
+
+// initKeys are the config keys which can be filled by the init command either through
+// flags (--machine-type) or environment variables (C553_MACHINE_TYPE).
+var initKeys = []string{"project", "region", "zone", "machine_type", "sak_file", "quality"}
+
+// writeInitConfig writes a new serverConfigFile to confPath using the values from flags
+// and the environment. Flags take precedence over environment variables.
+func writeInitConfig(confPath string, flags map[string]string) (string, error) {
+	conf, err := zazabul.ParseConfig(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	values := make(map[string]string)
+	for _, key := range initKeys {
+		value := os.Getenv("C553_" + strings.ToUpper(key))
+		if flagValue, ok := flags[strings.ReplaceAll(key, "_", "-")]; ok {
+			value = flagValue
+		}
+		if value != "" {
+			values[key] = value
+		}
+	}
+
+	// the region can be derived from the zone. 'us-central1-a' is in 'us-central1'
+	if values["region"] == "" && values["zone"] != "" {
+		if dashIndex := strings.LastIndex(values["zone"], "-"); dashIndex != -1 {
+			values["region"] = values["zone"][:dashIndex]
+		}
+	}
+	conf.Update(values)
+
+	if DoesPathExists(confPath) {
+		return "", fmt.Errorf("the file '%s' already exists", confPath)
+	}
+
+	err = conf.Write(confPath)
+	if err != nil {
+		return "", err
+	}
+
+	return confPath, nil
+}
+
+// getConfigPath returns the path of a file given on the command line. Relative paths are
+// looked for in the working directory and then in the current directory. Files which are in
+// neither, like new serverConfigFiles, are put in the working directory.
+func getConfigPath(rootPath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	rootedPath := filepath.Join(rootPath, name)
+	if DoesPathExists(rootedPath) {
+		return rootedPath
+	}
+	if absPath, err := filepath.Abs(name); err == nil && DoesPathExists(absPath) {
+		return absPath
 	}
+	return rootedPath
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+)
+
+var (
+	// jsonMode is set by the --json flag. The result of a command is then printed as json
+	// and every other message goes to stderr.
+	jsonMode bool
+
+	// out is where progress messages are written.
+	out io.Writer = os.Stdout
+)
+
+// CommandResult is the outcome of a successful command.
+type CommandResult struct {
+	Command       string  `json:"command"`
+	Instance      string  `json:"instance,omitempty"`
+	ConfigPath    string  `json:"config_path,omitempty"`
+	OutputPath    string  `json:"output_path,omitempty"`
+	Detached      bool    `json:"detached,omitempty"`
+	Pending       bool    `json:"pending,omitempty"`
+	Duration      float64 `json:"duration_seconds"`
+	EstimatedCost float64 `json:"estimated_cost_usd"`
+
+	// Job is the ID of the render on the server and BlenderPath the file it renders.
+	Job           string          `json:"job,omitempty"`
+	BlenderPath   string          `json:"blender_path,omitempty"`
+	BlenderSHA256 string          `json:"blender_sha256,omitempty"`
+	Settings      *RenderSettings `json:"settings,omitempty"`
+	MachineType   string          `json:"machine_type,omitempty"`
+
+	// Shots are the outcomes of the shots of the batch command.
+	Shots []ShotResult `json:"shots,omitempty"`
+	// Bench are the machine types compared by the bench command.
+	Bench []BenchResult `json:"bench,omitempty"`
+	// History are the records listed by the history command.
+	History []HistoryRecord `json:"history,omitempty"`
+}
+
+func setJSONMode() {
+	jsonMode = true
+	out = os.Stderr
+	color.Disable()
+}
+
+// printResult prints the result of a command. It only prints in json mode as the
+// commands print their progress while running.
+func printResult(result *CommandResult) {
+	if !jsonMode || result == nil {
+		return
+	}
+
+	raw, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(raw))
+}
+
+// exitWithError prints err and exits with the code of its kind.
+func exitWithError(err error) {
+	exitWithResult(nil, err)
+}
+
+// exitWithResult prints err along with the result of a command which failed part way and
+// exits with the code of its kind. The result is only printed in json mode as the commands
+// print their progress while running.
+func exitWithResult(result *CommandResult, err error) {
+	code := 1
+	kind := ""
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) {
+		code = c553Err.Kind.ExitCode()
+		kind = c553Err.Kind.String()
+	}
+
+	if jsonMode {
+		output := map[string]any{
+			"error":     err.Error(),
+			"kind":      kind,
+			"exit_code": code,
+		}
+		if result != nil {
+			output["result"] = result
+		}
+		raw, _ := json.MarshalIndent(output, "", "  ")
+		fmt.Println(string(raw))
+	} else {
+		color.Red.Println(err.Error())
+	}
+
+	os.Exit(code)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+)
+
+// Timeouts are how long each phase of talking to a render server may take. They are set
+// in the serverConfigFile with Go durations like '45m' or '2h'.
+type Timeouts struct {
+	// Operation is for Google Cloud operations like starting or stopping a server.
+	Operation time.Duration
+	// Boot is for the agents to respond after a server is started.
+	Boot time.Duration
+	// Provisioning is for the startup script to configure a new server.
+	Provisioning time.Duration
+	// Upload is for sending a blender file to a server.
+	Upload time.Duration
+	// Render is for a render to finish.
+	Render time.Duration
+}
+
+var defaultTimeouts = Timeouts{
+	Operation:    10 * time.Minute,
+	Boot:         10 * time.Minute,
+	Provisioning: 45 * time.Minute,
+	Upload:       30 * time.Minute,
+	Render:       12 * time.Hour,
+}
+
+// getTimeouts reads the timeouts of a serverConfigFile using the defaults for the empty ones.
+func getTimeouts(conf zazabul.Config) (Timeouts, error) {
+	timeouts := defaultTimeouts
+	fields := map[string]*time.Duration{
+		"operation_timeout":    &timeouts.Operation,
+		"boot_timeout":         &timeouts.Boot,
+		"provisioning_timeout": &timeouts.Provisioning,
+		"upload_timeout":       &timeouts.Upload,
+		"render_timeout":       &timeouts.Render,
+	}
+
+	for key, field := range fields {
+		if conf.Get(key) == "" {
+			continue
+		}
+		value, err := time.ParseDuration(conf.Get(key))
+		if err != nil || value <= 0 {
+			return timeouts, newError(ConfigError, "The field '%s' expects a duration like '45m' or '2h'", key)
+		}
+		*field = value
+	}
+
+	return timeouts, nil
+}
+
+// errTimedOut is returned by pollUntil when its timeout passes.
+var errTimedOut = errors.New("timed out")
+
+// pollUntil calls check until it reports done. The waits between calls start at minWait and
+// double up to maxWait with some jitter so that many clients don't poll in step.
+// It returns errTimedOut after timeout and an InterruptError when ctx is cancelled.
+func pollUntil(ctx context.Context, timeout, minWait, maxWait time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	wait := minWait
+
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errTimedOut
+		}
+
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if sleep > remaining {
+			sleep = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return newError(InterruptError, "interrupted")
+		case <-time.After(sleep):
+		}
+
+		wait *= 2
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+// timeoutError is the error for a phase which did not finish within its timeout.
+func timeoutError(kind ErrorKind, phase string, timeout time.Duration) error {
+	return newError(kind, "%s did not finish within %s", phase, timeout)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// previewInterval is how often rnd saves a preview of the render.
+const previewInterval = time.Minute
+
+// previewPath is where the preview of a blender file is saved: next to it as
+// '<name>.preview.jpg'.
+func previewPath(blenderPath string) string {
+	return strings.TrimSuffix(blenderPath, filepath.Ext(blenderPath)) + ".preview.jpg"
+}
+
+// savePreview saves the last frame rendered by a job next to its blender file. It returns
+// false when no frame has been rendered yet.
+func savePreview(ctx context.Context, agent *Agent, jobID, blenderPath string) (bool, error) {
+	resp, err := agent.get(ctx, "/jobs/preview?format=jpeg&id="+url.QueryEscape(jobID))
+	if err != nil {
+		return false, wrapError(AgentError, interruptedOr(ctx, err), "could not get the preview")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, newError(AgentError, "could not get the preview: the server responded with %d", resp.StatusCode)
+	}
+
+	// the preview is written to a '.part' file first so that image viewers never show half of it.
+	outPath := previewPath(blenderPath)
+	partFile, err := os.Create(outPath + ".part")
+	if err != nil {
+		return false, wrapError(RenderError, err, "could not save the preview")
+	}
+	_, err = io.Copy(partFile, resp.Body)
+	partFile.Close()
+	if err != nil {
+		os.Remove(outPath + ".part")
+		return false, wrapError(AgentError, interruptedOr(ctx, err), "could not get the preview")
+	}
+	err = os.Rename(outPath+".part", outPath)
+	if err != nil {
+		return false, wrapError(RenderError, err, "could not save the preview")
+	}
+	return true, nil
+}
+
+// doPreview saves the last frame rendered by a detached render next to its blender file.
+func doPreview(ctx context.Context, serverConfigPath string) (*CommandResult, error) {
+	rootPath, _ := GetRootPath()
+
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	job, err := loadDetachedJob(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), job.Instance).Context(ctx).Do()
+	if err != nil {
+		return nil, wrapError(ProvisioningError, err, "could not get the render server's details")
+	}
+	if instance.Status == "SUSPENDED" {
+		return nil, newError(ProvisioningError, "The render server is suspended. Run 'attach %s' to resume it.",
+			filepath.Base(serverConfigPath))
+	}
+	if instance.Status != "RUNNING" {
+		return nil, newError(ProvisioningError, "The render server is no longer running (status: %s)", instance.Status)
+	}
+
+	err = ensureFirewallRule(ctx, computeService, conf, job.Instance)
+	if err != nil {
+		return nil, err
+	}
+	timeouts, _ := getTimeouts(conf)
+	agent, err := connectAgent(ctx, computeService, conf, job.Instance, timeouts.Boot)
+	if err == errTimedOut {
+		err = timeoutError(AgentError, "connecting to the render server's agents", timeouts.Boot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := savePreview(ctx, agent, job.JobID, job.BlenderPath)
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		fmt.Fprintf(out, "No frame of '%s' has been rendered yet.\n", filepath.Base(job.BlenderPath))
+		return &CommandResult{
+			Command:    "preview",
+			Instance:   job.Instance,
+			ConfigPath: serverConfigPath,
+			Pending:    true,
+		}, nil
+	}
+
+	fmt.Fprintf(out, "Preview: %s\n", previewPath(job.BlenderPath))
+	return &CommandResult{
+		Command:    "preview",
+		Instance:   job.Instance,
+		ConfigPath: serverConfigPath,
+		OutputPath: previewPath(job.BlenderPath),
+	}, nil
+}
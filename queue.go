@@ -0,0 +1,528 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+)
+
+// RenderSettings are how a blender file is rendered. Empty settings use what the blender
+// file says except for Engine and Format which default to CYCLES and AVIJPEG.
+//
+// Every combination of Scenes, Cameras and ViewLayers is rendered with its own output
+// folder like 'Scene/Camera/'.
+type RenderSettings struct {
+	Scenes []string `json:"scenes,omitempty"`
+	// Cameras are camera objects or timeline markers bound to cameras.
+	Cameras    []string `json:"cameras,omitempty"`
+	ViewLayers []string `json:"view_layers,omitempty"`
+	// Frames is either a range like '1-120' or a list in blender's syntax like '1,5,10..20'.
+	Frames string `json:"frames,omitempty"`
+	Format string `json:"format,omitempty"`
+	Engine string `json:"engine,omitempty"`
+
+	// Still renders the Frames as images instead of an animation. Format then defaults to PNG.
+	Still bool `json:"still,omitempty"`
+	// Resolution is like '3840x2160'. The resolution of the blender file is used when empty.
+	Resolution string `json:"resolution,omitempty"`
+}
+
+var (
+	renderEngines = []string{"CYCLES", "BLENDER_EEVEE", "BLENDER_EEVEE_NEXT", "BLENDER_WORKBENCH"}
+	renderFormats = []string{"AVIJPEG", "AVIRAW", "FFMPEG", "PNG", "JPEG", "BMP", "TIFF", "OPEN_EXR",
+		"OPEN_EXR_MULTILAYER", "TARGA", "WEBP"}
+	// formatAliases are the other names of the formats people are used to.
+	formatAliases    = map[string]string{"EXR": "OPEN_EXR", "JPG": "JPEG", "TIF": "TIFF"}
+	framesRegexp     = regexp.MustCompile(`^[0-9][0-9,.+\-]*$`)
+	resolutionRegexp = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+)
+
+// validate checks the settings before they are sent to the agents.
+func (settings RenderSettings) validate() error {
+	for _, names := range [][]string{settings.Scenes, settings.Cameras, settings.ViewLayers} {
+		if err := validateNames(names); err != nil {
+			return err
+		}
+	}
+	if settings.Frames != "" && !framesRegexp.MatchString(settings.Frames) {
+		return newError(ConfigError, "The frames '%s' are not like '1-120' or '1,5,10..20'", settings.Frames)
+	}
+	if settings.Still && settings.Frames == "" {
+		return newError(ConfigError, "A still render needs the frames to render")
+	}
+	if settings.Resolution != "" && !resolutionRegexp.MatchString(settings.Resolution) {
+		return newError(ConfigError, "The resolution '%s' is not like '3840x2160'", settings.Resolution)
+	}
+	if settings.Format != "" && !isOneOf(renderFormats, settings.Format) {
+		return newError(ConfigError, "The format '%s' is not one of %s", settings.Format, strings.Join(renderFormats, ", "))
+	}
+	if settings.Engine != "" && !isOneOf(renderEngines, settings.Engine) {
+		return newError(ConfigError, "The engine '%s' is not one of %s", settings.Engine, strings.Join(renderEngines, ", "))
+	}
+	return nil
+}
+
+// frameCount is how many frames the settings render, counting every combination of Scenes,
+// Cameras and ViewLayers. It is zero when the Frames are empty or can't be counted.
+func (settings RenderSettings) frameCount() int {
+	if settings.Frames == "" {
+		return 0
+	}
+	count := 0
+	for _, item := range strings.Split(settings.Frames, ",") {
+		first, last, isRange := strings.Cut(item, "..")
+		if !isRange {
+			first, last, isRange = strings.Cut(item, "-")
+		}
+		if !isRange {
+			last = first
+		}
+		firstFrame, err1 := strconv.Atoi(first)
+		lastFrame, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || lastFrame < firstFrame {
+			return 0
+		}
+		count += lastFrame - firstFrame + 1
+	}
+	for _, names := range [][]string{settings.Scenes, settings.Cameras, settings.ViewLayers} {
+		count *= max(len(names), 1)
+	}
+	return count
+}
+
+// parseFormat reads a format given by the user. Formats are case insensitive and may be
+// given by their formatAliases like 'exr'.
+func parseFormat(value string) string {
+	format := strings.ToUpper(strings.TrimSpace(value))
+	if alias, ok := formatAliases[format]; ok {
+		return alias
+	}
+	return format
+}
+
+func isOneOf(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitNames splits a list of names separated by commas.
+func splitNames(value string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateNames checks the names of scenes, cameras or view layers. They are used as
+// folder names for the outputs.
+func validateNames(names []string) error {
+	for _, name := range names {
+		if strings.HasPrefix(name, "-") || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+			return newError(ConfigError, "'%s' can't be used as the name of a scene, camera or view layer", name)
+		}
+	}
+	return nil
+}
+
+// qualityEngines are the engines picked by the quality of a serverConfigFile.
+var qualityEngines = map[string]string{
+	"low":  "BLENDER_EEVEE",
+	"high": "CYCLES",
+}
+
+func (settings RenderSettings) form() url.Values {
+	form := url.Values{}
+	form.Set("scenes", strings.Join(settings.Scenes, ","))
+	form.Set("cameras", strings.Join(settings.Cameras, ","))
+	form.Set("view_layers", strings.Join(settings.ViewLayers, ","))
+	form.Set("frames", settings.Frames)
+	form.Set("format", settings.Format)
+	form.Set("engine", settings.Engine)
+	form.Set("resolution", settings.Resolution)
+	if settings.Still {
+		form.Set("still", "true")
+	}
+	return form
+}
+
+// AgentJob is a render in the queue of the agents.
+type AgentJob struct {
+	ID     string `json:"id"`
+	File   string `json:"file"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	// Started and Finished are when the agents began and stopped rendering the job.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// IsFinished tells whether the agents will not render the job anymore.
+func (job *AgentJob) IsFinished() bool {
+	return job.Status == "done" || job.Status == "failed" || job.Status == "cancelled" || job.Status == "skipped"
+}
+
+// submitBlend sends a blender file to the agents which queue it for rendering. form has the
+// settings of the job. It returns the ID of the job.
+func submitBlend(ctx context.Context, agent *Agent, blenderPath string, form url.Values,
+	timeout time.Duration) (string, error) {
+	rawBlenderFile, err := os.ReadFile(blenderPath)
+	if err != nil {
+		return "", wrapError(ConfigError, err, "could not read the blender file")
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for key, values := range form {
+		writer.WriteField(key, values[0])
+	}
+	part, err := writer.CreateFormFile("file", filepath.Base(blenderPath))
+	if err != nil {
+		return "", wrapError(AgentError, err, "could not prepare the upload")
+	}
+	part.Write(rawBlenderFile)
+	err = writer.Close()
+	if err != nil {
+		return "", wrapError(AgentError, err, "could not prepare the upload")
+	}
+
+	uploadCtx, cancelUpload := context.WithTimeout(ctx, timeout)
+	defer cancelUpload()
+	req, err := http.NewRequestWithContext(uploadCtx, "POST", agent.URL("/jobs"), body)
+	if err != nil {
+		return "", wrapError(AgentError, err, "could not prepare the upload")
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := agent.transfer.Do(req)
+	if uploadCtx.Err() == context.DeadlineExceeded {
+		return "", timeoutError(AgentError, "uploading the blender file", timeout)
+	}
+	if err != nil {
+		return "", wrapError(AgentError, interruptedOr(ctx, err), "could not upload the blender file")
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	receipt, err := checkReceipt(respBody, blenderPath)
+	if err != nil {
+		return "", err
+	}
+	return receipt.Job, nil
+}
+
+// stageBlend tells the agents to get the blender file of job from the bucket and queue it.
+// The agents put the outputs in the bucket and stop the server when done unless stopMode is
+// suspend. The server is then suspended by the client. It returns the ID of the job.
+func stageBlend(ctx context.Context, agent *Agent, job *DetachedJob, settings RenderSettings, stopMode string,
+	timeout time.Duration) (string, error) {
+	stageCtx, cancelStage := context.WithTimeout(ctx, timeout)
+	defer cancelStage()
+
+	form := settings.form()
+	form.Set("bucket", job.Bucket)
+	form.Set("prefix", job.Prefix)
+	form.Set("file", filepath.Base(job.BlenderPath))
+	form.Set("shutdown", "true")
+	form.Set("stop_mode", stopMode)
+	req, err := http.NewRequestWithContext(stageCtx, "POST", agent.URL("/jobs/stage"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", wrapError(AgentError, err, "could not prepare the staging request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := agent.transfer.Do(req)
+	if stageCtx.Err() == context.DeadlineExceeded {
+		return "", timeoutError(AgentError, "getting the blender file from the bucket", timeout)
+	}
+	if err != nil {
+		return "", wrapError(AgentError, interruptedOr(ctx, err), "could not reach the render server")
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	receipt, err := checkReceipt(respBody, job.BlenderPath)
+	if err != nil {
+		return "", err
+	}
+	return receipt.Job, nil
+}
+
+// queueBaked tells the agents to render the file baked by the job fromJobID once it is
+// done. form has the settings of the job. It returns the ID of the job.
+func queueBaked(ctx context.Context, agent *Agent, fromJobID string, form url.Values) (string, error) {
+	form.Set("from", fromJobID)
+	req, err := http.NewRequestWithContext(ctx, "POST", agent.URL("/jobs"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", wrapError(AgentError, err, "could not prepare the queueing request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := agent.client.Do(req)
+	if err != nil {
+		return "", wrapError(AgentError, interruptedOr(ctx, err), "could not reach the render server")
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	receipt := Receipt{}
+	err = json.Unmarshal(respBody, &receipt)
+	if err != nil || receipt.Status != "ok" {
+		return "", newError(AgentError, "the render server did not queue the render: %s", strings.TrimSpace(string(respBody)))
+	}
+	return receipt.Job, nil
+}
+
+// getAgentJob gets the status of a job from the agents.
+func getAgentJob(ctx context.Context, agent *Agent, jobID string) (*AgentJob, error) {
+	resp, err := agent.get(ctx, "/jobs/status?id="+url.QueryEscape(jobID))
+	if err != nil {
+		return nil, wrapError(AgentError, interruptedOr(ctx, err), "could not get the status of the render")
+	}
+	defer resp.Body.Close()
+
+	job := &AgentJob{}
+	err = json.NewDecoder(resp.Body).Decode(job)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return nil, newError(AgentError, "the render server does not know the render '%s'", jobID)
+	}
+	return job, nil
+}
+
+// maxStatusFailures is how many status checks in a row may fail before the render server is
+// taken to be gone, like when it was stopped or preempted.
+const maxStatusFailures = 5
+
+// statusPoller gets the status of jobs while waiting for them. A failed check, like a network
+// blip or the agents restarting, is reported and gives nil so that it counts as not finished.
+// Once maxStatusFailures checks in a row have failed, it gives an AgentError.
+type statusPoller struct {
+	failures int
+}
+
+func (poller *statusPoller) job(ctx context.Context, agent *Agent, jobID string) (*AgentJob, error) {
+	job, err := getAgentJob(ctx, agent, jobID)
+	if err == nil {
+		poller.failures = 0
+		return job, nil
+	}
+	// pollUntil reports the interruption.
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+
+	poller.failures += 1
+	if poller.failures >= maxStatusFailures {
+		return nil, wrapError(AgentError, err, fmt.Sprintf("The render server did not answer %d status checks in a row. "+
+			"It may have been stopped or preempted", poller.failures))
+	}
+	fmt.Fprintln(out, color.Red.Sprintf("\n%s", err))
+	return nil, nil
+}
+
+// getAgentManifest gets the list of outputs of a job from the agents.
+func getAgentManifest(ctx context.Context, agent *Agent, jobID string) (*Manifest, error) {
+	resp, err := agent.get(ctx, "/jobs/manifest?id="+url.QueryEscape(jobID))
+	if err != nil {
+		return nil, wrapError(AgentError, interruptedOr(ctx, err), "could not get the manifest of the outputs")
+	}
+	defer resp.Body.Close()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(resp.Body).Decode(manifest)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return nil, newError(AgentError, "could not get the manifest of the outputs")
+	}
+	if len(manifest.Files) == 0 {
+		return nil, newError(RenderError, "the render made no outputs")
+	}
+	return manifest, nil
+}
+
+// downloadJobOutput downloads an output of a job from the agents to outPath.
+func downloadJobOutput(ctx context.Context, agent *Agent, jobID string, entry ManifestEntry, outPath string,
+	policy ExistsPolicy) error {
+	err := downloadFile(ctx, agent.transfer, agent.URL("/jobs/output?id="+url.QueryEscape(jobID)+"&p="+
+		url.QueryEscape(entry.Path)), outPath, policy)
+	if err != nil {
+		return wrapError(RenderError, err, "could not download '"+entry.Path+"'")
+	}
+	return nil
+}
+
+// ListEntry is a file in the output folder of a job as listed by the agents.
+type ListEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// getAgentList lists the files in the output folder of a job.
+func getAgentList(ctx context.Context, agent *Agent, jobID string) ([]ListEntry, error) {
+	resp, err := agent.get(ctx, "/jobs/list?id="+url.QueryEscape(jobID))
+	if err != nil {
+		return nil, wrapError(AgentError, interruptedOr(ctx, err), "could not list the outputs")
+	}
+	defer resp.Body.Close()
+
+	list := make([]ListEntry, 0)
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return nil, newError(AgentError, "could not list the outputs")
+	}
+	return list, nil
+}
+
+// localOutputPath is where an output is mirrored in outDir. Outputs outside outDir are
+// refused.
+func localOutputPath(outDir, relPath string) (string, error) {
+	outPath := filepath.Join(outDir, filepath.FromSlash(relPath))
+	if !strings.HasPrefix(outPath, filepath.Clean(outDir)+string(filepath.Separator)) {
+		return "", newError(AgentError, "the render server listed an output outside its output folder: '%s'", relPath)
+	}
+	return outPath, nil
+}
+
+// downloadJobOutputs mirrors the output folder of a job from the agents into outDir and
+// checks the files against their manifest. With archive, the outputs are downloaded as a
+// single tar which is quicker for many small files but can't be resumed.
+func downloadJobOutputs(ctx context.Context, agent *Agent, jobID, outDir string, policy ExistsPolicy, archive bool) error {
+	manifest, err := getAgentManifest(ctx, agent, jobID)
+	if err != nil {
+		return err
+	}
+	list, err := getAgentList(ctx, agent, jobID)
+	if err != nil {
+		return err
+	}
+
+	downloads := make(map[string]ManifestEntry)
+	entries := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		outPath, err := localOutputPath(outDir, entry.Path)
+		if err != nil {
+			return err
+		}
+		downloads[outPath] = entry
+		entries[entry.Path] = true
+	}
+
+	mismatches := make([]string, 0)
+	for _, listEntry := range list {
+		if !entries[listEntry.Path] {
+			mismatches = append(mismatches, listEntry.Path)
+		}
+	}
+	if len(mismatches) > 0 {
+		return newError(RenderError, "the render server has outputs which are not in the manifest: %s",
+			strings.Join(mismatches, ", "))
+	}
+	if len(list) != len(manifest.Files) {
+		return newError(RenderError, "the render server has %d outputs but the manifest lists %d", len(list),
+			len(manifest.Files))
+	}
+
+	if archive {
+		err = extractJobArchive(ctx, agent, jobID, outDir, policy)
+		if err != nil {
+			return err
+		}
+	} else {
+		for outPath, entry := range downloads {
+			err = downloadJobOutput(ctx, agent, jobID, entry, outPath, policy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return verifyDownloads(downloads)
+}
+
+// extractJobArchive downloads the outputs of a job as a tar and extracts it into outDir.
+// Every file is written to a '.part' file first so that a cut archive leaves no partial
+// outputs.
+func extractJobArchive(ctx context.Context, agent *Agent, jobID, outDir string, policy ExistsPolicy) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", agent.URL("/jobs/archive?id="+url.QueryEscape(jobID)), nil)
+	if err != nil {
+		return wrapError(AgentError, err, "could not prepare the archive download")
+	}
+	resp, err := agent.transfer.Do(req)
+	if err != nil {
+		return wrapError(RenderError, interruptedOr(ctx, err), "could not download the outputs archive")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newError(RenderError, "could not download the outputs archive: the server responded with %d", resp.StatusCode)
+	}
+
+	tarReader := tar.NewReader(resp.Body)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return wrapError(RenderError, interruptedOr(ctx, err), "the outputs archive was cut short")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		outPath, err := localOutputPath(outDir, header.Name)
+		if err != nil {
+			return err
+		}
+		if DoesPathExists(outPath) && policy == SkipExisting {
+			fmt.Fprintf(out, "Skipping '%s' as it already exists. Use --overwrite to replace it.\n", outPath)
+			continue
+		}
+
+		fmt.Fprintf(out, "Extracting '%s' (%s)\n", header.Name, formatBytes(header.Size))
+		os.MkdirAll(filepath.Dir(outPath), 0777)
+		partFile, err := os.Create(outPath + ".part")
+		if err != nil {
+			return wrapError(RenderError, err, "could not save '"+header.Name+"'")
+		}
+		_, err = io.Copy(partFile, tarReader)
+		partFile.Close()
+		if err != nil {
+			return wrapError(RenderError, interruptedOr(ctx, err), "the outputs archive was cut short")
+		}
+		err = os.Rename(outPath+".part", outPath)
+		if err != nil {
+			return wrapError(RenderError, err, "could not save '"+header.Name+"'")
+		}
+	}
+}
+
+// cancelRender asks the agents to cancel a job or every unfinished job when jobID is
+// empty. The server is stopped after this so failures are ignored.
+func cancelRender(agent *Agent, jobID string) {
+	if agent == nil {
+		return
+	}
+	resp, err := agent.client.Post(agent.URL("/cancel?id="+url.QueryEscape(jobID)), "text/plain", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
@@ -1,65 +1,112 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"fmt"
-	"mime/multipart"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gookit/color"
+	"github.com/pkg/errors"
 	"github.com/saenuma/zazabul"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
 )
 
-func waitForOperationZone(project, zone string, service *compute.Service, op *compute.Operation) error {
-	ctx := context.Background()
-	for {
-		result, err := service.ZoneOperations.Get(project, zone, op.Name).Context(ctx).Do()
+func waitForOperationZone(ctx context.Context, project, zone string, service *compute.Service, op *compute.Operation,
+	timeout time.Duration) error {
+	return waitForOperation(ctx, op, timeout, func() (*compute.Operation, error) {
+		return service.ZoneOperations.Get(project, zone, op.Name).Context(ctx).Do()
+	})
+}
+
+func waitForOperationGlobal(ctx context.Context, project string, service *compute.Service, op *compute.Operation,
+	timeout time.Duration) error {
+	return waitForOperation(ctx, op, timeout, func() (*compute.Operation, error) {
+		return service.GlobalOperations.Get(project, op.Name).Context(ctx).Do()
+	})
+}
+
+func waitForOperation(ctx context.Context, op *compute.Operation, timeout time.Duration,
+	getOperation func() (*compute.Operation, error)) error {
+	err := pollUntil(ctx, timeout, time.Second, 10*time.Second, func() (bool, error) {
+		result, err := getOperation()
 		if err != nil {
-			return fmt.Errorf("failed retriving operation status: %s", err)
+			return false, wrapError(ProvisioningError, interruptedOr(ctx, err), "failed retriving operation status")
 		}
 
 		if result.Status == "DONE" {
 			if result.Error != nil {
-				var errors []string
-				for _, e := range result.Error.Errors {
-					errors = append(errors, e.Message)
-				}
-				return fmt.Errorf("operation failed with error(s): %s", strings.Join(errors, ", "))
+				return false, operationError(result.Error)
 			}
-			break
+			return true, nil
 		}
-		time.Sleep(time.Second)
+		return false, nil
+	})
+	if err == errTimedOut {
+		return timeoutError(ProvisioningError, "the operation '"+op.OperationType+"'", timeout)
 	}
-	return nil
+	return err
 }
 
-func doPrep(serverConfigPath string) {
-	rootPath, _ := GetRootPath()
+// DiskSettings are the disks a server is prepared with.
+type DiskSettings struct {
+	SizeGb int64
+	Type   string
+	// DataSizeGb is the size of the disk for the blender files and the outputs. There is no
+	// such disk when it is zero.
+	DataSizeGb int64
+}
 
-	conf, err := zazabul.LoadConfigFile(serverConfigPath)
-	if err != nil {
-		panic(err)
-	}
+var defaultDiskSettings = DiskSettings{SizeGb: 10, Type: "pd-ssd"}
 
-	for _, item := range conf.Items {
-		if item.Value == "" {
-			color.Red.Println("Every field in the launch file is compulsory.")
-			os.Exit(1)
+// getDiskSettings reads the disks of a serverConfigFile using the defaults for the empty fields.
+func getDiskSettings(conf zazabul.Config) (DiskSettings, error) {
+	disks := defaultDiskSettings
+	if conf.Get("disk_type") != "" {
+		disks.Type = conf.Get("disk_type")
+	}
+	fields := map[string]*int64{
+		"disk_size_gb":      &disks.SizeGb,
+		"data_disk_size_gb": &disks.DataSizeGb,
+	}
+	for key, field := range fields {
+		if conf.Get(key) == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(conf.Get(key), 10, 64)
+		if err != nil || value <= 0 {
+			return disks, newError(ConfigError, "The field '%s' expects a number of GB like '50'", key)
 		}
+		*field = value
+	}
+	if disks.SizeGb < defaultDiskSettings.SizeGb {
+		return disks, newError(ConfigError, "The field 'disk_size_gb' must be at least %d", defaultDiskSettings.SizeGb)
 	}
 
-	credentialsFilePath := filepath.Join(rootPath, conf.Get("sak_file"))
-	if !DoesPathExists(credentialsFilePath) {
-		color.Red.Printf("The file '%s' does not exist in '%s'\n", conf.Get("sak_file"), rootPath)
-		os.Exit(1)
+	return disks, nil
+}
+
+func doPrep(ctx context.Context, serverConfigPath string) (result *CommandResult, err error) {
+	rootPath, _ := GetRootPath()
+	beginTime := time.Now()
+
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Get("name") != "" {
+		return nil, newError(ConfigError, "The serverConfigFile '%s' has already been used to prepare '%s'",
+			serverConfigPath, conf.Get("name"))
 	}
+	timeouts, _ := getTimeouts(conf)
 
 	instanceName := fmt.Sprintf("c553-%s", strings.ToLower(UntestedRandomString(10)))
 
@@ -77,19 +124,26 @@ sudo snap install blender --classic
 curl -sSO https://dl.google.com/cloudagents/add-google-cloud-ops-agent-repo.sh
 sudo bash add-google-cloud-ops-agent-repo.sh --also-install
 
-sudo mkdir -p /tmp/c553_in/
-sudo rm -rf /tmp/t1/ # clean the output folder incase of reuse.
-
-gcloud compute firewall-rules create c553rules --direction ingress \
---source-ranges 0.0.0.0/0 --rules tcp:8089 --action allow
-
-# download needed files
-wget https://sae.ng/static/c553/c553_mover
-wget https://sae.ng/static/c553/c553_mover.service
-wget https://sae.ng/static/c553/c553_shutdown
-wget https://sae.ng/static/c553/c553_shutdown.service
-wget https://sae.ng/static/c553/c553_render
-wget https://sae.ng/static/c553/c553_render.service
+sudo rm -rf /tmp/c553_jobs/ # clean the old jobs incase of reuse.
+sudo mkdir -p /tmp/c553_jobs/
+
+# the jobs are kept on the data disk when there is one. It is formatted on the first boot.
+DATA_DISK=/dev/disk/by-id/google-c553-data
+if [ -e $DATA_DISK ]; then
+  sudo blkid $DATA_DISK || sudo mkfs.ext4 -m 0 -E lazy_itable_init=0,lazy_journal_init=0,discard $DATA_DISK
+  sudo mount -o discard,defaults $DATA_DISK /tmp/c553_jobs/
+  sudo rm -rf /tmp/c553_jobs/*
+  sudo chmod 777 /tmp/c553_jobs/
+fi
+
+# download needed files. They are of the same version as this program.
+AGENTS_URL=https://sae.ng/static/c553/` + AppVersion + `
+wget $AGENTS_URL/c553_mover
+wget $AGENTS_URL/c553_mover.service
+wget $AGENTS_URL/c553_shutdown
+wget $AGENTS_URL/c553_shutdown.service
+wget $AGENTS_URL/c553_render
+wget $AGENTS_URL/c553_render.service
 
 # put the files in place
 sudo mkdir -p /opt/cartoons553/
@@ -110,37 +164,163 @@ sudo systemctl start c553_render
 sudo systemctl start c553_mover
 `
 
-	ctx := context.Background()
-	computeService, err := compute.NewService(ctx, option.WithCredentialsFile(credentialsFilePath),
-		option.WithScopes(compute.ComputeScope))
+	computeService, err := newComputeService(ctx, conf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	prefix := "https://www.googleapis.com/compute/v1/projects/" + conf.Get("project")
-
 	image, err := computeService.Images.GetFromFamily("ubuntu-os-cloud", "ubuntu-minimal-2204-lts").Context(ctx).Do()
 	if err != nil {
-		panic(err)
+		return nil, wrapError(ProvisioningError, err, "could not find the ubuntu image")
 	}
 	imageURL := image.SelfLink
 
-	instance := &compute.Instance{
+	metadata := []*compute.MetadataItems{
+		{
+			Key:   "startup-script",
+			Value: &startupScript,
+		},
+		{
+			// the agents publish the fingerprint of their certificate in a guest attribute.
+			Key:   "enable-guest-attributes",
+			Value: googleapi.String("TRUE"),
+		},
+	}
+
+	disks, _ := getDiskSettings(conf)
+	labels, _ := serverLabels(conf, serverConfigPath)
+	zones, err := candidateZones(ctx, computeService, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// a server which wasn't fully configured is not saved to the serverConfigFile so it is
+	// deleted on failures and interruptions.
+	created := false
+	defer func() {
+		if err == nil || !created {
+			return
+		}
+		fmt.Fprintln(out, "Deleting the unfinished render server.")
+		deleteErr := deleteInstance(context.Background(), computeService, conf, instanceName)
+		if deleteErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(deleteErr.Error()))
+		}
+		deleteErr = deleteFirewallRule(context.Background(), computeService, conf, instanceName)
+		if deleteErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(deleteErr.Error()))
+		}
+	}()
+
+	// zones without room for the machine type are skipped for the next one.
+	for i, zone := range zones {
+		conf.Update(map[string]string{"zone": zone})
+		boot := &compute.AttachedDiskInitializeParams{SourceImage: imageURL}
+		instance := serverInstance(conf, instanceName, conf.Get("machine_type"), disks, boot, metadata, labels)
+
+		var op *compute.Operation
+		op, err = computeService.Instances.Insert(conf.Get("project"), zone, instance).Context(ctx).Do()
+		if err == nil {
+			created = true
+			err = waitForOperationZone(ctx, conf.Get("project"), zone, computeService, op, timeouts.Operation)
+		}
+		if err == nil {
+			break
+		}
+		err = wrapError(ProvisioningError, err, "could not create the render server in "+zone)
+		if !isQuotaError(err) || i == len(zones)-1 {
+			return nil, err
+		}
+		fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+		fmt.Fprintf(out, "Trying %s instead.\n", zones[i+1])
+		if created {
+			deleteInstance(context.Background(), computeService, conf, instanceName)
+			created = false
+		}
+	}
+
+	fmt.Fprintln(out, "Started render server")
+
+	err = ensureFirewallRule(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = connectAgent(ctx, computeService, conf, instanceName, timeouts.Provisioning)
+	if err == errTimedOut {
+		err = timeoutError(ProvisioningError, "configuring the render server", timeouts.Provisioning)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = stopInstance(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(out, "Finished configuring render server.")
+	raw, _ := os.ReadFile(serverConfigPath)
+	newRaw := zoneLineRegexp.ReplaceAllString(string(raw), "zone: "+conf.Get("zone")) + "\n\n" + "name: " + instanceName
+	err = os.WriteFile(serverConfigPath, []byte(newRaw), 0777)
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not save the server name to the serverConfigFile")
+	}
+	fmt.Fprintln(out, "Server config path: ", serverConfigPath)
+
+	duration := time.Since(beginTime)
+	return &CommandResult{
+		Command:       "prep",
+		Instance:      instanceName,
+		ConfigPath:    serverConfigPath,
+		Duration:      duration.Seconds(),
+		EstimatedCost: estimateCost(ctx, computeService, conf, conf.Get("machine_type"), duration),
+	}, nil
+}
+
+// serverInstance describes a render server in the zone of conf. boot is where its boot disk
+// comes from, an image or a snapshot, and metadata has its startup script. The server and
+// its disks get labels.
+func serverInstance(conf zazabul.Config, instanceName, machineType string, disks DiskSettings,
+	boot *compute.AttachedDiskInitializeParams, metadata []*compute.MetadataItems,
+	labels map[string]string) *compute.Instance {
+	prefix := "https://www.googleapis.com/compute/v1/projects/" + conf.Get("project")
+	diskType := prefix + "/zones/" + conf.Get("zone") + "/diskTypes/" + disks.Type
+	boot.DiskType, boot.DiskSizeGb, boot.Labels = diskType, disks.SizeGb, labels
+
+	attachedDisks := []*compute.AttachedDisk{
+		{
+			AutoDelete: true,
+			Boot:       true,
+			Type:       "PERSISTENT",
+
+			InitializeParams: boot,
+		},
+	}
+	if disks.DataSizeGb > 0 {
+		attachedDisks = append(attachedDisks, &compute.AttachedDisk{
+			AutoDelete: true,
+			Type:       "PERSISTENT",
+			// the startup script finds the disk by this name.
+			DeviceName: "c553-data",
+
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskName:   instanceName + "-data",
+				DiskType:   diskType,
+				DiskSizeGb: disks.DataSizeGb,
+				Labels:     labels,
+			},
+		})
+	}
+
+	return &compute.Instance{
 		Name:        instanceName,
 		Description: "ooldim instance",
-		MachineType: prefix + "/zones/" + conf.Get("zone") + "/machineTypes/" + conf.Get("machine_type"),
-		Disks: []*compute.AttachedDisk{
-			{
-				AutoDelete: true,
-				Boot:       true,
-				Type:       "PERSISTENT",
-
-				InitializeParams: &compute.AttachedDiskInitializeParams{
-					SourceImage: imageURL,
-					DiskType:    prefix + "/zones/" + conf.Get("zone") + "/diskTypes/pd-ssd",
-					DiskSizeGb:  10,
-				},
-			},
+		MachineType: prefix + "/zones/" + conf.Get("zone") + "/machineTypes/" + machineType,
+		Tags: &compute.Tags{
+			Items: []string{instanceName},
 		},
+		Labels: labels,
+		Disks:  attachedDisks,
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
 				AccessConfigs: []*compute.AccessConfig{
@@ -157,224 +337,676 @@ sudo systemctl start c553_mover
 				Email: "default",
 				Scopes: []string{
 					compute.DevstorageFullControlScope,
-					compute.ComputeScope,
 				},
 			},
 		},
 		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				{
-					Key:   "startup-script",
-					Value: &startupScript,
-				},
-			},
+			Items: metadata,
 		},
 	}
+}
+
+// RenderOptions are the flags of the rnd and attach commands.
+type RenderOptions struct {
+	// Detach leaves the server rendering once the render has begun.
+	Detach bool
+
+	// ExistsPolicy is whether outputs which already exist are skipped or overwritten.
+	ExistsPolicy ExistsPolicy
+
+	// OnInterrupt is what to do when a render is interrupted: 'cancel', 'detach' or
+	// empty to ask.
+	OnInterrupt string
+
+	// Archive downloads the outputs from the agents as a single tar.
+	Archive bool
+
+	// Settings are the scenes, cameras and view layers to render.
+	Settings RenderSettings
+
+	// MachineType is the machine type to render with instead of the machine_type of the
+	// serverConfigFile. The server is changed back to its machine_type afterwards when
+	// RestoreMachineType is set.
+	MachineType        string
+	RestoreMachineType bool
+}
+
+func doRender(ctx context.Context, blenderPath, serverConfigPath string, opts RenderOptions) (result *CommandResult, err error) {
+	rootPath, _ := GetRootPath()
+
+	conf, instanceName, err := loadFreeServer(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	timeouts, _ := getTimeouts(conf)
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
 
-	op, err := computeService.Instances.Insert(conf.Get("project"), conf.Get("zone"), instance).Do()
+	job := &DetachedJob{
+		Instance:    instanceName,
+		BlenderPath: blenderPath,
+	}
+	_, job.BlenderSHA256, err = fileSHA256(blenderPath)
 	if err != nil {
-		panic(err)
+		return nil, wrapError(ConfigError, err, "could not read the blender file")
 	}
-	err = waitForOperationZone(conf.Get("project"), conf.Get("zone"), computeService, op)
+	job.MachineType, err = serverMachineType(ctx, computeService, conf, instanceName)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if opts.MachineType != "" {
+		_, err = computeService.MachineTypes.Get(conf.Get("project"), conf.Get("zone"), opts.MachineType).Context(ctx).Do()
+		if err != nil {
+			return nil, wrapError(ConfigError, err, fmt.Sprintf("the machine type '%s' is not available in %s",
+				opts.MachineType, conf.Get("zone")))
+		}
+	}
+
+	// with a bucket, the blender file is uploaded before the server is started so that the
+	// server is not paid for while uploading.
+	var storageService *storage.Service
+	if conf.Get("bucket") != "" {
+		storageService, err = newStorageService(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+		job.Bucket = conf.Get("bucket")
+		job.Prefix = stagingPrefix(instanceName, time.Now().Format(VersionFormat))
+
+		uploadCtx, cancelUpload := context.WithTimeout(ctx, timeouts.Upload)
+		defer cancelUpload()
+		err = uploadToBucket(uploadCtx, storageService, job.Bucket, path.Join(job.Prefix, "in", filepath.Base(blenderPath)),
+			blenderPath)
+		if uploadCtx.Err() == context.DeadlineExceeded {
+			return nil, timeoutError(AgentError, "uploading the blender file", timeouts.Upload)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "Uploaded blend file to gs://%s/%s\n", job.Bucket, job.Prefix)
+	}
+
+	// stop the server on failures and interruptions too, a running server costs money.
+	handedOver := false
+	defer func() {
+		if err == nil || handedOver {
+			return
+		}
+		stopErr := stopServer(context.Background(), computeService, conf, job)
+		if stopErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(stopErr.Error()))
+		}
+	}()
+
+	if opts.MachineType != "" && opts.MachineType != job.MachineType {
+		if opts.RestoreMachineType {
+			job.RestoreMachineType = job.MachineType
+		}
+		fmt.Fprintf(out, "Changing the render server from %s to %s\n", job.MachineType, opts.MachineType)
+		err = stopInstance(ctx, computeService, conf, instanceName)
+		if err != nil {
+			return nil, err
+		}
+		err = setMachineType(ctx, computeService, conf, instanceName, opts.MachineType)
+		if err != nil {
+			return nil, err
+		}
+		job.MachineType = opts.MachineType
 	}
 
-	fmt.Println("Started render server")
+	job.BeginTime = time.Now()
+	agent, err := startServer(ctx, computeService, conf, serverConfigPath, instanceName)
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) && c553Err.Kind == QuotaError {
+		return nil, wrapError(QuotaError, err, fmt.Sprintf("The project has no quota left to run %s. Ask for a quota "+
+			"increase, render with a smaller --machine-type or set fallback_zones", job.MachineType))
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	launchedInstance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	settings := opts.Settings
+	if settings.Engine == "" {
+		settings.Engine = qualityEngines[conf.Get("quality")]
+	}
+	job.Settings = settings
+	if job.Bucket != "" {
+		job.JobID, err = stageBlend(ctx, agent, job, settings, conf.Get("stop_mode"), timeouts.Upload)
+	} else {
+		job.JobID, err = submitBlend(ctx, agent, blenderPath, settings.form(), timeouts.Upload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(out, "Uploaded blend file and beginning render")
+	err = setLastJobLabel(ctx, computeService, conf, instanceName, blenderPath)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(out, color.Red.Sprint(err.Error()))
 	}
-	instanceIP := launchedInstance.NetworkInterfaces[0].AccessConfigs[0].NatIP
 
-	for {
-		_, err := http.Get("http://" + instanceIP + ":8089/ready")
+	job.RenderTime = time.Now()
+	handedOver = true
+	return followRender(ctx, serverConfigPath, conf, computeService, storageService, agent, job, opts)
+}
+
+// startServer starts or resumes a prepared server and connects to its agents. A server
+// whose zone has no room for it may be moved to one of the fallback_zones. The caller
+// stops the server on failures.
+func startServer(ctx context.Context, computeService *compute.Service, conf zazabul.Config, serverConfigPath,
+	instanceName string) (*Agent, error) {
+	timeouts, _ := getTimeouts(conf)
+	var op *compute.Operation
+	instance, err := settledInstance(ctx, computeService, conf, instanceName)
+	if err == nil && instance.Status == "SUSPENDED" {
+		fmt.Fprintln(out, "Resuming the render server")
+		op, err = computeService.Instances.Resume(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	} else if err == nil {
+		op, err = computeService.Instances.Start(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	}
+	if err == nil {
+		err = waitForOperationZone(ctx, conf.Get("project"), conf.Get("zone"), computeService, op, timeouts.Operation)
+	}
+	if err != nil {
+		err = wrapError(ProvisioningError, err, "could not start the render server")
+		if !isQuotaError(err) {
+			return nil, err
+		}
+		zones, zonesErr := candidateZones(ctx, computeService, conf)
+		if zonesErr != nil || len(zones) < 2 || !shouldMove(conf.Get("zone")) {
+			return nil, err
+		}
+		err = moveServer(ctx, computeService, conf, serverConfigPath, instanceName, zones[1:])
 		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
+			return nil, err
 		}
-		break
 	}
 
-	// stops the server
-	op, err = computeService.Instances.Stop(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	err = ensureFirewallRule(ctx, computeService, conf, instanceName)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	agent, err := connectAgent(ctx, computeService, conf, instanceName, timeouts.Boot)
+	if err == errTimedOut {
+		err = timeoutError(AgentError, "starting the render server's agents", timeouts.Boot)
 	}
-	err = waitForOperationZone(conf.Get("project"), conf.Get("zone"), computeService, op)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	fmt.Println("Finished configuring render server.")
-	raw, _ := os.ReadFile(serverConfigPath)
-	newRaw := string(raw) + "\n\n" + "name: " + instanceName
-	os.WriteFile(serverConfigPath, []byte(newRaw), 0777)
-	fmt.Println("Server config path: ", serverConfigPath)
+	return agent, nil
 }
 
-func doRender(blenderPath, serverConfigPath string) {
+// followRender waits for the render of job to finish, downloads its output and stops the
+// server. When interrupted or when asked to with --detach, it detaches from the render
+// leaving the server rendering. When interrupted, it can also cancel the render.
+// agent is nil when the server is no longer running.
+func followRender(ctx context.Context, serverConfigPath string, conf zazabul.Config, computeService *compute.Service,
+	storageService *storage.Service, agent *Agent, job *DetachedJob, opts RenderOptions) (result *CommandResult, err error) {
 	rootPath, _ := GetRootPath()
 
-	conf, err := zazabul.LoadConfigFile(serverConfigPath)
+	detached := false
+	defer func() {
+		if err == nil || detached {
+			return
+		}
+		stopErr := stopServer(context.Background(), computeService, conf, job)
+		if stopErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(stopErr.Error()))
+		}
+		removeDetachedJob(rootPath, serverConfigPath)
+	}()
+
+	detach := func() (*CommandResult, error) {
+		err := saveDetachedJob(rootPath, serverConfigPath, job)
+		if err != nil {
+			return nil, err
+		}
+		detached = true
+		if job.Bucket != "" && conf.Get("stop_mode") == "suspend" {
+			fmt.Fprintf(out, "Detached from the render. Run 'fetch %s' to get the outputs and suspend the server.\n",
+				filepath.Base(serverConfigPath))
+		} else if job.Bucket != "" {
+			fmt.Fprintf(out, "Detached from the render. The server stops itself when done. Run 'fetch %s' to get the outputs.\n",
+				filepath.Base(serverConfigPath))
+		} else {
+			fmt.Fprintf(out, "Detached from the render. Run 'attach %s' to continue it.\n", filepath.Base(serverConfigPath))
+		}
+		return &CommandResult{
+			Command:       "rnd",
+			Instance:      job.Instance,
+			ConfigPath:    serverConfigPath,
+			Detached:      true,
+			Job:           job.JobID,
+			BlenderPath:   job.BlenderPath,
+			BlenderSHA256: job.BlenderSHA256,
+			Settings:      &job.Settings,
+			MachineType:   job.MachineType,
+		}, nil
+	}
+	if opts.Detach {
+		return detach()
+	}
+
+	if agent != nil {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "The last rendered frame is saved to '%s' every minute.\n", previewPath(job.BlenderPath))
+		fmt.Fprintf(out, "The render server's certificate is self-signed. Its SHA-256 fingerprint is %s\n",
+			agent.Fingerprint)
+	}
+
+	timeouts, _ := getTimeouts(conf)
+	renderDeadline := job.RenderTime.Add(timeouts.Render)
+	var lastPreview time.Time
+	poller := &statusPoller{}
+	err = pollUntil(ctx, time.Until(renderDeadline), 10*time.Second, time.Minute, func() (bool, error) {
+		if job.Bucket != "" {
+			done, err := isStagedRenderDone(ctx, storageService, job.Bucket, job.Prefix)
+			if err != nil || done {
+				return done, err
+			}
+		} else {
+			agentJob, err := poller.job(ctx, agent, job.JobID)
+			if err != nil {
+				return false, err
+			}
+			if agentJob != nil && agentJob.IsFinished() {
+				if agentJob.Status != "done" {
+					return false, newError(RenderError, "The render %s: %s", agentJob.Status, agentJob.Error)
+				}
+				return true, nil
+			}
+		}
+		// a preview which can't be saved doesn't stop the render.
+		if agent != nil && time.Since(lastPreview) >= previewInterval {
+			lastPreview = time.Now()
+			savePreview(ctx, agent, job.JobID, job.BlenderPath)
+		}
+		fmt.Fprintf(out, "\rBeen rendering for: %s  ", time.Since(job.RenderTime).Round(time.Second).String())
+		return false, nil
+	})
+	if err == errTimedOut {
+		cancelRender(agent, job.JobID)
+		return nil, timeoutError(RenderError, "the render", timeouts.Render)
+	}
+	var c553Err *C553Error
+	if errors.As(err, &c553Err) && c553Err.Kind == InterruptError {
+		if !shouldDetach(opts) {
+			cancelRender(agent, job.JobID)
+			return nil, newError(InterruptError, "The render was cancelled.")
+		}
+		return detach()
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	for _, item := range conf.Items {
-		if item.Value == "" {
-			color.Red.Println("Every field in the launch file is compulsory.")
-			os.Exit(1)
+	fmt.Fprintln(out, "\nRendered now dowloading.")
+
+	dlPath := filepath.Join(rootPath, time.Now().Format(VersionFormat))
+	if job.Bucket != "" {
+		err = downloadStagedOutputs(ctx, storageService, job.Bucket, job.Prefix, dlPath, opts.ExistsPolicy)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = downloadJobOutputs(ctx, agent, job.JobID, dlPath, opts.ExistsPolicy, opts.Archive)
+		if err != nil {
+			return nil, err
 		}
 	}
-	credentialsFilePath := filepath.Join(rootPath, conf.Get("sak_file"))
-	if !DoesPathExists(credentialsFilePath) {
-		color.Red.Printf("The file '%s' does not exist in '%s'\n", conf.Get("sak_file"), rootPath)
-		os.Exit(1)
+
+	fmt.Fprintf(out, "Output: %s\n", dlPath)
+
+	err = stopServer(context.Background(), computeService, conf, job)
+	if err != nil {
+		return nil, err
+	}
+	removeDetachedJob(rootPath, serverConfigPath)
+
+	fmt.Fprintf(out, "Server %s.\n", parkedState(conf))
+
+	duration := time.Since(job.BeginTime)
+	cost := estimateCost(context.Background(), computeService, conf, firstNonEmpty(job.MachineType,
+		conf.Get("machine_type")), duration)
+	fmt.Fprintf(out, "Estimated cost: $%.2f\n", cost)
+
+	return &CommandResult{
+		Command:       "rnd",
+		Instance:      job.Instance,
+		ConfigPath:    serverConfigPath,
+		OutputPath:    dlPath,
+		Job:           job.JobID,
+		BlenderPath:   job.BlenderPath,
+		BlenderSHA256: job.BlenderSHA256,
+		Settings:      &job.Settings,
+		MachineType:   job.MachineType,
+		Duration:      duration.Seconds(),
+		EstimatedCost: cost,
+	}, nil
+}
+
+// shouldDetach tells whether to leave an interrupted render running. It asks when the
+// --on-interrupt flag was not given. When there is no one to answer, the render is cancelled.
+func shouldDetach(opts RenderOptions) bool {
+	if opts.OnInterrupt != "" {
+		return opts.OnInterrupt == "detach"
 	}
 
-	ctx := context.Background()
-	computeService, err := compute.NewService(ctx, option.WithCredentialsFile(credentialsFilePath),
-		option.WithScopes(compute.ComputeScope))
+	fmt.Fprint(out, "\nInterrupted. Type 'c' to cancel the render and stop the server or 'd' to detach and leave it rendering: ")
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		if answer == "d" {
+			return true
+		}
+		if answer == "c" || err != nil {
+			return false
+		}
+		fmt.Fprint(out, "Type 'c' or 'd': ")
+	}
+}
+
+// interruptedOr returns an InterruptError when ctx was cancelled else err.
+func interruptedOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return newError(InterruptError, "interrupted")
+	}
+	return err
+}
+
+func doDelete(ctx context.Context, serverConfigPath string) (*CommandResult, error) {
+	rootPath, _ := GetRootPath()
+
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	instanceName := conf.Get("name")
+	if instanceName == "" {
+		return nil, newError(ConfigError, "The serverConfigFile '%s' has no render server.", serverConfigPath)
+	}
 
-	// starts the server
-	op, err := computeService.Instances.Start(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	computeService, err := newComputeService(ctx, conf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = waitForOperationZone(conf.Get("project"), conf.Get("zone"), computeService, op)
+
+	err = deleteInstance(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	err = deleteFirewallRule(ctx, computeService, conf, instanceName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	launchedInstance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	os.RemoveAll(serverConfigPath)
+	removeDetachedJob(rootPath, serverConfigPath)
+	fmt.Fprintln(out, "All Done. Server Deleted.")
+
+	return &CommandResult{
+		Command:    "del",
+		Instance:   instanceName,
+		ConfigPath: serverConfigPath,
+	}, nil
+}
+
+// optionalKeys are the fields of a serverConfigFile which may be left empty.
+var optionalKeys = map[string]bool{
+	"bucket":               true,
+	"fallback_zones":       true,
+	"stop_mode":            true,
+	"owner":                true,
+	"project_tag":          true,
+	"labels":               true,
+	"disk_size_gb":         true,
+	"disk_type":            true,
+	"data_disk_size_gb":    true,
+	"on_complete":          true,
+	"on_failure":           true,
+	"allowed_cidrs":        true,
+	"vcpu_hour_cost":       true,
+	"gb_hour_cost":         true,
+	"operation_timeout":    true,
+	"boot_timeout":         true,
+	"provisioning_timeout": true,
+	"upload_timeout":       true,
+	"render_timeout":       true,
+}
+
+// loadFreeServer loads a serverConfigFile whose server is free to render: it has been
+// prepared and no detached render is still running on it. It returns the name of the server.
+func loadFreeServer(rootPath, serverConfigPath string) (zazabul.Config, string, error) {
+	conf, err := loadServerConfig(rootPath, serverConfigPath)
 	if err != nil {
-		panic(err)
+		return conf, "", err
 	}
-	instanceIP := launchedInstance.NetworkInterfaces[0].AccessConfigs[0].NatIP
+	instanceName := conf.Get("name")
+	if instanceName == "" {
+		return conf, "", newError(ConfigError, "The serverConfigFile '%s' has no render server. Run the prep command "+
+			"with it first.", serverConfigPath)
+	}
+	if DoesPathExists(detachedJobPath(rootPath, serverConfigPath)) {
+		return conf, "", newError(ConfigError, "A render is still running on '%s'. Run the attach or fetch command "+
+			"to continue it.", instanceName)
+	}
+	return conf, instanceName, nil
+}
 
-	for {
-		_, err := http.Get("http://" + instanceIP + ":8089/ready")
-		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
+// loadServerConfig loads a serverConfigFile and checks that its compulsory fields are filled.
+func loadServerConfig(rootPath, serverConfigPath string) (zazabul.Config, error) {
+	conf, err := zazabul.LoadConfigFile(serverConfigPath)
+	if err != nil {
+		return conf, wrapError(ConfigError, err, "could not read the serverConfigFile")
+	}
+
+	for _, item := range conf.Items {
+		if item.Value == "" && !optionalKeys[item.Name] {
+			return conf, newError(ConfigError, "Every field in the launch file is compulsory. '%s' is empty.", item.Name)
 		}
-		break
 	}
 
-	// upload blender file to render
-	rawBlenderFile, err := os.ReadFile(blenderPath)
+	// the sak_file is made absolute so that the services don't have to resolve it again.
+	credentialsFilePath := conf.Get("sak_file")
+	if !filepath.IsAbs(credentialsFilePath) {
+		credentialsFilePath = filepath.Join(filepath.Dir(serverConfigPath), conf.Get("sak_file"))
+		if !DoesPathExists(credentialsFilePath) {
+			credentialsFilePath = filepath.Join(rootPath, conf.Get("sak_file"))
+		}
+	}
+	if !DoesPathExists(credentialsFilePath) {
+		return conf, newError(ConfigError, "The file '%s' does not exist next to '%s' or in '%s'", conf.Get("sak_file"),
+			filepath.Base(serverConfigPath), rootPath)
+	}
+	conf.Update(map[string]string{"sak_file": credentialsFilePath})
+
+	_, err = getTimeouts(conf)
+	if err != nil {
+		return conf, err
+	}
+	_, err = getDiskSettings(conf)
+	if err != nil {
+		return conf, err
+	}
+	_, err = parseLabels(conf.Get("labels"))
 	if err != nil {
-		panic(err)
+		return conf, err
+	}
+	if mode := conf.Get("stop_mode"); mode != "" && mode != "stop" && mode != "suspend" {
+		return conf, newError(ConfigError, "The field 'stop_mode' expects 'stop' or 'suspend'")
 	}
 
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filepath.Base(blenderPath))
+	return conf, nil
+}
+
+func newComputeService(ctx context.Context, conf zazabul.Config) (*compute.Service, error) {
+	credentialsFilePath := conf.Get("sak_file")
+	computeService, err := compute.NewService(ctx, option.WithCredentialsFile(credentialsFilePath),
+		option.WithScopes(compute.ComputeScope))
 	if err != nil {
-		panic(err)
+		return nil, wrapError(AuthError, err, "could not connect to Google Cloud")
 	}
-	part.Write(rawBlenderFile)
-	err = writer.Close()
+
+	return computeService, nil
+}
+
+func getInstanceIP(ctx context.Context, computeService *compute.Service, project, zone, instanceName string) (string, error) {
+	launchedInstance, err := computeService.Instances.Get(project, zone, instanceName).Context(ctx).Do()
 	if err != nil {
-		panic(err)
+		return "", wrapError(ProvisioningError, err, "could not get the render server's details")
 	}
-	req, err := http.NewRequest("POST", "http://"+instanceIP+":8089/upload", body)
+
+	return launchedInstance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
+}
+
+// stopInstance stops a server. Servers which are already stopped are left alone as the
+// agents stop the server themselves after staging outputs to a bucket. Suspended servers
+// are stopped too, losing their memory.
+func stopInstance(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) error {
+	timeouts, _ := getTimeouts(conf)
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
 	if err != nil {
-		panic(err)
+		return wrapError(ProvisioningError, err, "could not get the render server's details")
+	}
+	if instance.Status == "TERMINATED" || instance.Status == "STOPPED" {
+		return nil
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	httpClient := &http.Client{}
-	_, err = httpClient.Do(req)
+	op, err := computeService.Instances.Stop(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not stop the render server")
+	}
+	err = waitForOperationZone(ctx, conf.Get("project"), conf.Get("zone"), computeService, op, timeouts.Operation)
 	if err != nil {
-		panic(err)
+		return wrapError(ProvisioningError, err, "could not stop the render server")
 	}
-	fmt.Println("Uploaded blend file and beginning render")
 
-	startTime := time.Now()
-	fmt.Println()
-	fmt.Printf("Click %s to download a preview of your render while it renders.\n",
-		"http://"+instanceIP+":8089/dlv/")
+	return nil
+}
 
-	for {
-		err := downloadFile("http://"+instanceIP+":8089/dl/?p="+"/tmp/c553_in/done.txt",
-			filepath.Join(rootPath, "done.txt"))
-		if err == nil {
-			break
+// settledInstance gets a server once it is no longer being suspended or stopped, as it can
+// only be resumed or started then.
+func settledInstance(ctx context.Context, computeService *compute.Service, conf zazabul.Config,
+	instanceName string) (*compute.Instance, error) {
+	timeouts, _ := getTimeouts(conf)
+	var instance *compute.Instance
+	err := pollUntil(ctx, timeouts.Operation, 2*time.Second, 10*time.Second, func() (bool, error) {
+		var err error
+		instance, err = computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+		if err != nil {
+			return false, wrapError(ProvisioningError, interruptedOr(ctx, err), "could not get the render server's details")
 		}
+		return instance.Status != "SUSPENDING" && instance.Status != "STOPPING", nil
+	})
+	if err == errTimedOut {
+		return nil, timeoutError(ProvisioningError, "waiting for the render server to be suspended or stopped",
+			timeouts.Operation)
+	}
+	return instance, err
+}
 
-		time.Sleep(10 * time.Second)
-		fmt.Printf("\rBeen rendering for: %s  ", time.Since(startTime).Round(time.Second).String())
+// parkInstance suspends a server when the stop_mode of conf is suspend and stops it
+// otherwise. A suspended server keeps its memory, so the next render begins without
+// booting it and its jobs are kept. A server which can't be suspended is stopped.
+func parkInstance(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) error {
+	if conf.Get("stop_mode") != "suspend" {
+		return stopInstance(ctx, computeService, conf, instanceName)
 	}
 
-	fmt.Println("\nRendered now dowloading.")
-	os.RemoveAll(filepath.Join(rootPath, "done.txt"))
+	timeouts, _ := getTimeouts(conf)
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not get the render server's details")
+	}
+	switch instance.Status {
+	case "TERMINATED", "STOPPED", "SUSPENDING", "SUSPENDED":
+		return nil
+	}
 
-	dlPath := filepath.Join(rootPath, time.Now().Format(VersionFormat)+".mpeg")
-	err = downloadFile("http://"+instanceIP+":8089/dlv/", dlPath)
+	op, err := computeService.Instances.Suspend(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+	if err == nil {
+		err = waitForOperationZone(ctx, conf.Get("project"), conf.Get("zone"), computeService, op, timeouts.Operation)
+	}
 	if err != nil {
-		fmt.Println(err)
+		err = wrapError(ProvisioningError, err, "could not suspend the render server")
+		fmt.Fprintln(out, color.Red.Sprint(err.Error()+". Stopping it instead."))
+		return stopInstance(ctx, computeService, conf, instanceName)
 	}
+	return nil
+}
 
-	fmt.Printf("Output: %s\n", dlPath)
+// parkedState is what parkInstance does to servers: 'suspended' or 'stopped'.
+func parkedState(conf zazabul.Config) string {
+	if conf.Get("stop_mode") == "suspend" {
+		return "suspended"
+	}
+	return "stopped"
+}
 
-	// stops the server
-	op, err = computeService.Instances.Stop(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
+// stopServer parks the server of job. It is stopped instead when it has to be changed back
+// to the machine type it had.
+func stopServer(ctx context.Context, computeService *compute.Service, conf zazabul.Config, job *DetachedJob) error {
+	if job.RestoreMachineType == "" || job.RestoreMachineType == job.MachineType {
+		return parkInstance(ctx, computeService, conf, job.Instance)
+	}
+	err := stopInstance(ctx, computeService, conf, job.Instance)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = waitForOperationZone(conf.Get("project"), conf.Get("zone"), computeService, op)
+	err = setMachineType(ctx, computeService, conf, job.Instance, job.RestoreMachineType)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	fmt.Println("Server stopped.")
+	fmt.Fprintf(out, "Changed the render server back to %s\n", job.RestoreMachineType)
+	return nil
 }
 
-func doDelete(serverConfigPath string) {
-	rootPath, _ := GetRootPath()
-
-	conf, err := zazabul.LoadConfigFile(serverConfigPath)
+// serverMachineType returns the machine type a server has now. It can differ from the
+// machine_type of its serverConfigFile after rendering with --machine-type.
+func serverMachineType(ctx context.Context, computeService *compute.Service, conf zazabul.Config,
+	instanceName string) (string, error) {
+	instance, err := computeService.Instances.Get(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
 	if err != nil {
-		panic(err)
+		return "", wrapError(ProvisioningError, err, "could not get the render server's details")
 	}
+	return path.Base(instance.MachineType), nil
+}
 
-	for _, item := range conf.Items {
-		if item.Value == "" {
-			color.Red.Println("Every field in the launch file is compulsory.")
-			os.Exit(1)
-		}
+// setMachineType changes the machine type of a stopped server.
+func setMachineType(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName,
+	machineType string) error {
+	timeouts, _ := getTimeouts(conf)
+	req := &compute.InstancesSetMachineTypeRequest{
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", conf.Get("zone"), machineType),
 	}
-	credentialsFilePath := filepath.Join(rootPath, conf.Get("sak_file"))
-	if !DoesPathExists(credentialsFilePath) {
-		color.Red.Printf("The file '%s' does not exist in '%s'\n", conf.Get("sak_file"), rootPath)
-		os.Exit(1)
+	op, err := computeService.Instances.SetMachineType(conf.Get("project"), conf.Get("zone"), instanceName, req).
+		Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not change the render server to "+machineType)
 	}
-
-	ctx := context.Background()
-	computeService, err := compute.NewService(ctx, option.WithCredentialsFile(credentialsFilePath),
-		option.WithScopes(compute.ComputeScope))
+	err = waitForOperationZone(ctx, conf.Get("project"), conf.Get("zone"), computeService, op, timeouts.Operation)
 	if err != nil {
-		panic(err)
+		return wrapError(ProvisioningError, err, "could not change the render server to "+machineType)
 	}
-	instanceName := conf.Get("name")
 
-	// delete the server
+	return nil
+}
+
+func deleteInstance(ctx context.Context, computeService *compute.Service, conf zazabul.Config, instanceName string) error {
+	timeouts, _ := getTimeouts(conf)
 	op, err := computeService.Instances.Delete(conf.Get("project"), conf.Get("zone"), instanceName).Context(ctx).Do()
 	if err != nil {
-		panic(err)
+		return wrapError(ProvisioningError, err, "could not delete the render server")
 	}
-	err = waitForOperationZone(conf.Get("project"), conf.Get("zone"), computeService, op)
+	err = waitForOperationZone(ctx, conf.Get("project"), conf.Get("zone"), computeService, op, timeouts.Operation)
 	if err != nil {
-		panic(err)
+		return wrapError(ProvisioningError, err, "could not delete the render server")
 	}
 
-	os.RemoveAll(serverConfigPath)
-	fmt.Println("All Done. Server Deleted.")
+	return nil
 }
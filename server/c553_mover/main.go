@@ -1,34 +1,135 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/saenuma/cartoons553/server/gcs"
+	"github.com/saenuma/cartoons553/server/jobs"
 )
 
 func main() {
-	// Upload route
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/set_quality/", registerQuality)
-	http.HandleFunc("/dl/", downloadHandler)
+	os.MkdirAll(jobs.Root, 0777)
+
+	// job routes
+	http.HandleFunc("/jobs", jobHandler)
+	http.HandleFunc("/jobs/stage", stageHandler)
+	http.HandleFunc("/jobs/status", statusHandler)
+	http.HandleFunc("/jobs/output", outputHandler)
+	http.HandleFunc("/jobs/list", listHandler)
+	http.HandleFunc("/jobs/archive", archiveHandler)
+	http.HandleFunc("/jobs/preview", previewHandler)
+	http.HandleFunc("/jobs/manifest", manifestHandler)
+	http.HandleFunc("/cancel", cancelHandler)
 	http.HandleFunc("/dlv/", downloadVid)
 	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "yeah")
+		fmt.Fprint(w, jobs.Version)
 	})
 
-	//Listen on port 8080
-	err := http.ListenAndServe(":8089", nil)
+	fingerprint, err := ensureCertificate()
 	if err != nil {
 		panic(err)
 	}
+
+	// the client only connects after the fingerprint is published so it is retried until
+	// the metadata server is reachable.
+	go func() {
+		for {
+			err := publishFingerprint(fingerprint)
+			if err == nil {
+				return
+			}
+			fmt.Println(err)
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	// long uploads and downloads keep the server in use until they end.
+	go func() {
+		for range time.Tick(time.Minute) {
+			if inFlight.Load() > 0 {
+				jobs.Touch()
+			}
+		}
+	}()
+
+	//Listen on port 8089
+	err = http.ListenAndServeTLS(":8089", CertPath, KeyPath, trackActivity(http.DefaultServeMux))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// inFlight is the number of requests being served.
+var inFlight atomic.Int64
+
+// trackActivity records every request of the client so that c553_shutdown doesn't shut
+// down a server which is in use.
+func trackActivity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		jobs.Touch()
+		defer func() {
+			inFlight.Add(-1)
+			jobs.Touch()
+		}()
+		handler.ServeHTTP(w, r)
+	})
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
+// jobHandler adds a blender file sent by the client to the queue.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	// the upload is refused before it is read when there is no room for it.
+	err := jobs.CheckFreeSpace(r.ContentLength)
+	if err != nil {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+
 	// Maximum upload of 10 MB files
 	r.ParseMultipartForm(10000 << 20)
 
+	settings := formSettings(r)
+	err = settings.Validate()
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+	after, err := formAfter(r)
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+
+	// a job from a bake job renders the baked file so nothing is uploaded.
+	if from := r.FormValue("from"); from != "" {
+		fromJob, err := jobs.Load(from)
+		if err != nil || !fromJob.Bake {
+			fmt.Fprintf(w, "not_ok: '%s' is not a bake job", from)
+			return
+		}
+		job := jobs.New(fromJob.File, settings)
+		job.After, job.From = after, from
+		err = jobs.Save(job)
+		if err != nil {
+			fmt.Fprintf(w, "not_ok: %s", err)
+			return
+		}
+		writeReceipt(w, job.ID, job.File, 0, "")
+		return
+	}
+
 	file, handler, err := r.FormFile("file")
 	if err != nil {
 		fmt.Fprintf(w, "not_ok")
@@ -43,31 +144,238 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 		return
 	}
-	os.MkdirAll("/tmp/c553_in/", 0777)
-	err = os.WriteFile("/tmp/c553_in/"+handler.Filename, rawFile, 0777)
+	job := jobs.New(handler.Filename, settings)
+	job.After = after
+	job.Bake = r.FormValue("bake") == "true"
+	err = os.WriteFile(job.InputPath(), rawFile, 0777)
 	if err != nil {
 		fmt.Fprintf(w, "not_ok")
 		fmt.Println(err)
 		return
 	}
-	fmt.Fprintf(w, "ok")
+
+	// the job is only in the queue once saved so c553_render never sees a partial file.
+	err = jobs.Save(job)
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+
+	sum := sha256.Sum256(rawFile)
+	writeReceipt(w, job.ID, job.File, int64(len(rawFile)), hex.EncodeToString(sum[:]))
+}
+
+// formAfter reads the jobs to wait for. They are given as 'name=id' pairs separated by
+// commas and must already be in the queue.
+func formAfter(r *http.Request) (map[string]string, error) {
+	if r.FormValue("after") == "" {
+		return nil, nil
+	}
+
+	after := make(map[string]string)
+	for _, pair := range strings.Split(r.FormValue("after"), ",") {
+		name, id, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("'%s' is not like 'name=id'", pair)
+		}
+		if _, err := jobs.Load(id); err != nil {
+			return nil, fmt.Errorf("there is no job '%s'", id)
+		}
+		after[name] = id
+	}
+	return after, nil
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, r.FormValue("p"))
+// formList reads a list of names separated by commas.
+func formList(r *http.Request, key string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(r.FormValue(key), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func formSettings(r *http.Request) jobs.Settings {
+	return jobs.Settings{
+		Scenes:     formList(r, "scenes"),
+		Cameras:    formList(r, "cameras"),
+		ViewLayers: formList(r, "view_layers"),
+		Frames:     r.FormValue("frames"),
+		Format:     r.FormValue("format"),
+		Engine:     r.FormValue("engine"),
+		Still:      r.FormValue("still") == "true",
+		Resolution: r.FormValue("resolution"),
+	}
+}
+
+// Receipt tells the client what was received so that it can compare checksums.
+type Receipt struct {
+	Status string `json:"status"`
+	Job    string `json:"job"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func writeReceipt(w http.ResponseWriter, jobID, fileName string, size int64, sum string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Receipt{Status: "ok", Job: jobID, File: fileName, Size: size, SHA256: sum})
+}
+
+// currentJob is the job rendering or else the last job added. It is nil when there are no jobs.
+func currentJob() *jobs.Job {
+	list := jobs.List()
+	if len(list) == 0 {
+		return nil
+	}
+	job := list[len(list)-1]
+	for _, queued := range list {
+		if queued.Status == jobs.Running {
+			job = queued
+		}
+	}
+	return job
 }
 
+// downloadVid serves the latest output of the job being rendered or else of the last job.
 func downloadVid(w http.ResponseWriter, r *http.Request) {
-	rawFIs, _ := os.ReadDir("/tmp/t1")
-	toDlPath := filepath.Join("/tmp/t1/", rawFIs[0].Name())
+	job := currentJob()
+	if job == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	toDlPath := ""
+	var toDlTime time.Time
+	filepath.WalkDir(jobs.OutDir(job.ID), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil && info.ModTime().After(toDlTime) {
+			toDlPath, toDlTime = path, info.ModTime()
+		}
+		return nil
+	})
+	if toDlPath == "" {
+		http.NotFound(w, r)
+		return
+	}
 	fmt.Println(toDlPath)
 	http.ServeFile(w, r, toDlPath)
 }
 
-func registerQuality(w http.ResponseWriter, r *http.Request) {
-	quality := r.FormValue("q")
-	if quality != "" {
-		os.WriteFile("/tmp/render_quality.txt", []byte(quality), 0777)
+// stageHandler gets a blender file from a bucket and adds it to the queue. The outputs are
+// put back in the bucket by c553_render.
+func stageHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, prefix := r.FormValue("bucket"), r.FormValue("prefix")
+	fileName := filepath.Base(r.FormValue("file"))
+	if bucket == "" || prefix == "" || !strings.HasSuffix(fileName, ".blend") {
+		fmt.Fprintf(w, "not_ok: expects a bucket, a prefix and a blender file")
+		return
+	}
+	settings := formSettings(r)
+	err := settings.Validate()
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+	err = jobs.CheckFreeSpace(0)
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+
+	job := jobs.New(fileName, settings)
+	job.Bucket, job.Prefix = bucket, prefix
+	job.Shutdown = r.FormValue("shutdown") == "true"
+	job.StopMode = r.FormValue("stop_mode")
+	err = gcs.Download(bucket, prefix+"/in/"+fileName, job.InputPath())
+	if err != nil {
+		fmt.Println(err)
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+	size, sum, err := jobs.FileSHA256(job.InputPath())
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+	err = jobs.Save(job)
+	if err != nil {
+		fmt.Fprintf(w, "not_ok: %s", err)
+		return
+	}
+	writeReceipt(w, job.ID, fileName, size, sum)
+}
+
+// statusHandler reports a job. Without an id, it reports every job.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("id") == "" {
+		json.NewEncoder(w).Encode(jobs.List())
+		return
+	}
+
+	job, err := jobs.Load(r.FormValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// outputHandler serves an output of a job. p is relative to the job's output folder.
+func outputHandler(w http.ResponseWriter, r *http.Request) {
+	outDir := jobs.OutDir(r.FormValue("id"))
+	outPath := filepath.Join(outDir, filepath.FromSlash(r.FormValue("p")))
+	if !isWithin(outDir, jobs.Root) || !isWithin(outPath, outDir) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, outPath)
+}
+
+// manifestHandler sends the list of outputs of a job.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	manifestPath := jobs.ManifestPath(r.FormValue("id"))
+	if !isWithin(manifestPath, jobs.Root) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, manifestPath)
+}
+
+// isWithin tells whether path is inside dir so that ids and paths like '../x' from the
+// client can't reach other folders.
+func isWithin(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// cancelHandler cancels a job. Without an id, it cancels every unfinished job.
+// c553_render then marks them as cancelled.
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	running := false
+	for _, job := range jobs.List() {
+		if job.IsFinished() || (r.FormValue("id") != "" && job.ID != r.FormValue("id")) {
+			continue
+		}
+		jobs.Cancel(job.ID)
+		if job.Status == jobs.Running {
+			running = true
+		}
+	}
+	if running {
+		exec.Command("pkill", "blender").Run()
 	}
 	fmt.Fprintf(w, "ok")
 }
+
+func DoesPathExists(p string) bool {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
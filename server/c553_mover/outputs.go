@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/saenuma/cartoons553/server/jobs"
+)
+
+// ListEntry is a file in the output folder of a job.
+type ListEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// walkOutputs calls fn for every file in the output folder of a job with its path relative
+// to the folder.
+func walkOutputs(jobID string, fn func(path, rel string, info os.FileInfo) error) error {
+	outDir := jobs.OutDir(jobID)
+	if !isWithin(outDir, jobs.Root) {
+		return os.ErrNotExist
+	}
+	return filepath.WalkDir(outDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outDir, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(rel), info)
+	})
+}
+
+// listHandler lists the outputs of a job. Unlike the manifest, it can be asked for while
+// the job is rendering.
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := jobs.Load(r.FormValue("id")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	list := make([]ListEntry, 0)
+	err := walkOutputs(r.FormValue("id"), func(path, rel string, info os.FileInfo) error {
+		list = append(list, ListEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// archiveHandler streams the outputs of a job as a tar or, with format=zip, a zip archive.
+// The archive is made while it is sent.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := r.FormValue("id")
+	if _, err := jobs.Load(jobID); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	if r.FormValue("format") == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+jobID+".zip\"")
+		zipWriter := zip.NewWriter(w)
+		err = walkOutputs(jobID, func(path, rel string, info os.FileInfo) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = rel
+			entryWriter, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			return copyFile(entryWriter, path)
+		})
+		if err == nil {
+			err = zipWriter.Close()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+jobID+".tar\"")
+		tarWriter := tar.NewWriter(w)
+		err = walkOutputs(jobID, func(path, rel string, info os.FileInfo) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = rel
+			err = tarWriter.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+			return copyFile(tarWriter, path)
+		})
+		if err == nil {
+			err = tarWriter.Close()
+		}
+	}
+
+	// the headers are already sent so a failure can only cut the archive short.
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/saenuma/cartoons553/server/jobs"
+)
+
+// defaultPreviewWidth is the width of previews when none is asked for.
+const defaultPreviewWidth = 640
+
+// previewHandler sends the last frame rendered by a job scaled down to the width asked
+// for as a PNG or, with format=jpeg, a JPEG. Without an id it is the job rendering.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := r.FormValue("id")
+	if jobID == "" {
+		job := currentJob()
+		if job == nil {
+			http.NotFound(w, r)
+			return
+		}
+		jobID = job.ID
+	}
+
+	width := defaultPreviewWidth
+	if r.FormValue("width") != "" {
+		var err error
+		width, err = strconv.Atoi(r.FormValue("width"))
+		if err != nil || width <= 0 {
+			http.Error(w, "the width is not a number above 0", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !isWithin(jobs.PreviewPath(jobID), jobs.Root) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(jobs.PreviewPath(jobID))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	frame, err := png.Decode(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	preview := scaleDown(frame, width)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Job-Id", jobID)
+	if r.FormValue("format") == "jpeg" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		jpeg.Encode(w, preview, &jpeg.Options{Quality: 85})
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, preview)
+	}
+}
+
+// scaleDown shrinks img to width keeping its aspect ratio. Each pixel is the average of the
+// pixels it covers. Images already narrower are returned as they are.
+func scaleDown(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height == 0 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			scaled.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return scaled
+}
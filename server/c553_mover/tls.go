@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// the certificate is kept on the boot disk so that it stays the same across restarts.
+	CertPath = "/opt/cartoons553/tls/cert.pem"
+	KeyPath  = "/opt/cartoons553/tls/key.pem"
+
+	FingerprintURL = "http://metadata.google.internal/computeMetadata/v1/instance/guest-attributes/c553/fingerprint"
+)
+
+// ensureCertificate creates a self-signed certificate on the first boot. It returns the
+// SHA-256 fingerprint of the certificate.
+func ensureCertificate() (string, error) {
+	if !DoesPathExists(CertPath) || !DoesPathExists(KeyPath) {
+		err := createCertificate()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	rawCert, err := os.ReadFile(CertPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(rawCert)
+	if block == nil {
+		return "", fmt.Errorf("'%s' is not a PEM certificate", CertPath)
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func createCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	rawCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(CertPath), 0700)
+	err = os.WriteFile(KeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(CertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert}), 0644)
+}
+
+// publishFingerprint writes the fingerprint to the instance's guest attributes where the
+// client reads it from.
+func publishFingerprint(fingerprint string) error {
+	req, err := http.NewRequest("PUT", FingerprintURL, strings.NewReader(fingerprint))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publishing the fingerprint failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
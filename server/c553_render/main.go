@@ -4,34 +4,61 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/radovskyb/watcher"
+	"github.com/saenuma/cartoons553/server/gcs"
+	"github.com/saenuma/cartoons553/server/jobs"
 )
 
 func main() {
 
 	for {
-		if DoesPathExists("/tmp/c553_in/") {
-			fmt.Println("In path found.")
+		if DoesPathExists(jobs.Root) {
+			fmt.Println("Jobs path found.")
 			break
 		} else {
-			fmt.Println("Trying to connect to in path")
+			fmt.Println("Trying to connect to jobs path")
 			time.Sleep(10 * time.Second)
 			continue
 		}
 	}
 
-	// watch for new files
+	// the worker renders the queue whenever a job is added. It is also nudged regularly in
+	// case an event was missed.
+	nudge := make(chan bool, 1)
+	go func() {
+		for range nudge {
+			for job := jobs.Next(); job != nil; job = jobs.Next() {
+				doRender(job)
+			}
+		}
+	}()
+	wake := func() {
+		select {
+		case nudge <- true:
+		default:
+		}
+	}
+	wake()
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			wake()
+		}
+	}()
+
+	// watch for new jobs
 	w := watcher.New()
 
 	go func() {
 		for {
 			select {
 			case event := <-w.Event:
-				if strings.HasSuffix(event.Path, ".blend") {
-					go doRender(event.Path)
+				if filepath.Base(event.Path) == "job.json" {
+					wake()
 				}
 
 			case err := <-w.Error:
@@ -42,7 +69,7 @@ func main() {
 		}
 	}()
 
-	if err := w.AddRecursive("/tmp/c553_in/"); err != nil {
+	if err := w.AddRecursive(jobs.Root); err != nil {
 		panic(err)
 	}
 
@@ -52,16 +79,298 @@ func main() {
 
 }
 
-func doRender(path string) {
-	fmt.Println("found: " + path)
-	raw, _ := os.ReadFile("/tmp/render_quality.txt")
-	if string(raw) == "low" {
-		exec.Command("blender", "-b", path, "-o", "/tmp/t1/", "-E", "BLENDER_EEVEE", "-F", "AVIJPEG", "-a").Run()
+// bakeScript bakes every point cache of the scene then saves the file to the path given.
+const bakeScript = `import bpy
+bpy.ops.ptcache.bake_all(bake=True)
+bpy.ops.wm.save_as_mainfile(filepath=%q, relative_remap=True)
+`
+
+var rangeRegexp = regexp.MustCompile(`^([0-9]+)-([0-9]+)$`)
+
+// partScript picks the camera and the view layer of a part. A camera can also be the name
+// of a timeline marker bound to a camera. Markers switch cameras while rendering so they are
+// unbound once a camera is picked.
+const partScript = `import bpy
+scene = bpy.context.scene
+camera_name = %q
+if camera_name:
+    camera = bpy.data.objects.get(camera_name)
+    if camera is None:
+        for marker in scene.timeline_markers:
+            if marker.name == camera_name and marker.camera is not None:
+                camera = marker.camera
+    if camera is None or camera.type != 'CAMERA':
+        raise Exception("there is no camera or marker named " + camera_name)
+    scene.camera = camera
+    for marker in scene.timeline_markers:
+        marker.camera = None
+view_layer_name = %q
+if view_layer_name:
+    if view_layer_name not in scene.view_layers:
+        raise Exception("there is no view layer named " + view_layer_name)
+    for view_layer in scene.view_layers:
+        view_layer.use = view_layer.name == view_layer_name
+`
+
+// resolutionScript sets the resolution of the output.
+const resolutionScript = `import bpy
+bpy.context.scene.render.resolution_x = %s
+bpy.context.scene.render.resolution_y = %s
+bpy.context.scene.render.resolution_percentage = 100
+`
+
+// previewScript saves every frame as it is rendered to the path given as a PNG. It uses a
+// scene of its own for the PNG settings as the outputs are often movies. The frame is
+// written to a temporary file first so that it is never read half written.
+const previewScript = `import bpy, os
+preview_path = %q
+preview_scene = bpy.data.scenes.new("c553_preview")
+preview_scene.render.image_settings.file_format = 'PNG'
+preview_scene.render.image_settings.color_mode = 'RGB'
+preview_scene.render.image_settings.color_depth = '8'
+def save_preview(scene, *args):
+    try:
+        bpy.data.images['Render Result'].save_render(preview_path + ".tmp.png", scene=preview_scene)
+        os.replace(preview_path + ".tmp.png", preview_path)
+    except Exception as e:
+        print("could not save the preview:", e)
+bpy.app.handlers.render_write.append(save_preview)
+`
+
+// blenderArgs are the arguments of blender for a part of a job. The order matters as
+// blender acts on them in turn.
+func blenderArgs(job *jobs.Job, part jobs.Part) []string {
+	engine, format := job.Engine, job.Format
+	if engine == "" {
+		engine = "CYCLES"
+	}
+	if format == "" && job.Still {
+		format = "PNG"
+	} else if format == "" {
+		format = "AVIJPEG"
+	}
+
+	args := []string{"-b", job.InputPath(), "--python-exit-code", "1"}
+	if part.Scene != "" {
+		args = append(args, "-S", part.Scene)
+	}
+	if job.Bake {
+		// the caches are written next to the blender file, see moveCaches.
+		bakedPath := filepath.Join(jobs.OutDir(job.ID), job.File)
+		return append(args, "--python-expr", fmt.Sprintf(bakeScript, bakedPath))
+	}
+	if part.Camera != "" || part.ViewLayer != "" {
+		args = append(args, "--python-expr", fmt.Sprintf(partScript, part.Camera, part.ViewLayer))
+	}
+	if width, height, ok := strings.Cut(job.Resolution, "x"); ok {
+		args = append(args, "--python-expr", fmt.Sprintf(resolutionScript, width, height))
+	}
+	args = append(args, "--python-expr", fmt.Sprintf(previewScript, jobs.PreviewPath(job.ID)))
+	outDir := filepath.Join(jobs.OutDir(job.ID), part.Path)
+	args = append(args, "-o", outDir+"/", "-E", engine, "-F", format)
+
+	parts := rangeRegexp.FindStringSubmatch(job.Frames)
+	if parts != nil && job.Still {
+		args = append(args, "-f", parts[1]+".."+parts[2])
+	} else if parts != nil {
+		args = append(args, "-s", parts[1], "-e", parts[2], "-a")
+	} else if job.Frames != "" {
+		args = append(args, "-f", job.Frames)
+	} else {
+		args = append(args, "-a")
+	}
+	return args
+}
+
+// runBlender runs blender. Its failures include the end of its output.
+func runBlender(args []string) error {
+	output, err := exec.Command("blender", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s\n%s", err, lastLines(string(output), 5))
+	}
+	return nil
+}
+
+func doRender(job *jobs.Job) {
+	fmt.Println("rendering job " + job.ID + ": " + job.File)
+	job.Status = jobs.Running
+	job.Started = time.Now()
+	if jobs.IsCancelled(job.ID) {
+		job.Status = jobs.Cancelled
+	} else if failed := jobs.FailedDependency(job); failed != "" {
+		job.Status = jobs.Skipped
+		job.Error = failed + " was not done"
 	} else {
-		exec.Command("blender", "-b", path, "-o", "/tmp/t1/", "-E", "CYCLES", "-F", "AVIJPEG", "-a").Run()
+		jobs.Save(job)
+
+		// outputs which fill the disk fail the render half way so the job fails early instead.
+		err := jobs.CheckFreeSpace(0)
+		if err == nil {
+			err = shareDependencies(job)
+		}
+		if err == nil && job.Bake {
+			err = runBlender(blenderArgs(job, job.Parts[0]))
+			if err == nil {
+				err = moveCaches(job)
+			}
+		} else if err == nil {
+			err = renderParts(job)
+		}
+
+		if jobs.IsCancelled(job.ID) {
+			job.Status = jobs.Cancelled
+		} else if err != nil {
+			job.Status = jobs.Failed
+			job.Error = strings.TrimSpace(err.Error())
+		} else {
+			job.Status = jobs.Done
+		}
+	}
+
+	err := jobs.WriteManifest(job.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// jobs staged in a bucket have their outputs put back in the bucket. The server is then
+	// stopped when asked to as the client may not be connected. done.txt tells the client the
+	// status of the job and its error. A job whose outputs could not be uploaded has failed.
+	if job.Bucket != "" {
+		err := gcs.UploadDir(job.Bucket, job.Prefix+"/out", jobs.OutDir(job.ID))
+		if err == nil {
+			err = gcs.Upload(job.Bucket, job.Prefix+"/manifest.json", jobs.ManifestPath(job.ID))
+		}
+		if err != nil {
+			fmt.Println(err)
+			if job.Status == jobs.Done {
+				job.Status = jobs.Failed
+				job.Error = "could not upload the outputs to the bucket: " + err.Error()
+			}
+		}
+		donePath := filepath.Join(jobs.Dir(job.ID), "done.txt")
+		os.WriteFile(donePath, []byte(string(job.Status)+"\n"+job.Error), 0777)
+		err = gcs.Upload(job.Bucket, job.Prefix+"/done.txt", donePath)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	job.Finished = time.Now()
+	err = jobs.Save(job)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if job.Shutdown && job.StopMode != "suspend" && jobs.Next() == nil {
+		exec.Command("sudo", "shutdown", "-h", "now").Run()
+	}
+}
+
+// renderParts renders the parts of a job in turn. A part which fails doesn't stop the
+// others. The failures are returned together.
+func renderParts(job *jobs.Job) error {
+	failures := make([]string, 0)
+	for i := range job.Parts {
+		part := &job.Parts[i]
+		if jobs.IsCancelled(job.ID) {
+			part.Status = jobs.Cancelled
+			continue
+		}
+
+		part.Status = jobs.Running
+		jobs.Save(job)
+		err := runBlender(blenderArgs(job, *part))
+		if jobs.IsCancelled(job.ID) {
+			part.Status = jobs.Cancelled
+		} else if err != nil {
+			part.Status = jobs.Failed
+			part.Error = err.Error()
+			name := part.Path
+			if name == "" {
+				name = job.File
+			}
+			failures = append(failures, name+": "+part.Error)
+		} else {
+			part.Status = jobs.Done
+		}
+		jobs.Save(job)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d parts failed\n%s", len(failures), len(job.Parts), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// shareDependencies puts the outputs of the jobs that job waited for next to its blender
+// file. A blender file can then use the outputs of a job named 'shot1' as '//shot1/'.
+// A job rendering a baked file gets the baked file and its caches first.
+func shareDependencies(job *jobs.Job) error {
+	if job.From != "" {
+		err := copyDir(jobs.OutDir(job.From), jobs.InDir(job.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, id := range job.After {
+		linkPath := filepath.Join(jobs.InDir(job.ID), name)
+		os.RemoveAll(linkPath)
+		err := os.Symlink(jobs.OutDir(id), linkPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveCaches moves the caches written by a bake next to the baked file so that they are
+// found when it is rendered.
+func moveCaches(job *jobs.Job) error {
+	dirEntries, err := os.ReadDir(jobs.InDir(job.ID))
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !strings.HasPrefix(dirEntry.Name(), "blendcache_") {
+			continue
+		}
+		err = os.Rename(filepath.Join(jobs.InDir(job.ID), dirEntry.Name()),
+			filepath.Join(jobs.OutDir(job.ID), dirEntry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDir(fromDir, toDir string) error {
+	return filepath.WalkDir(fromDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fromDir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(toDir, rel), 0777)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(toDir, rel), raw, 0777)
+	})
+}
+
+// lastLines returns the last n lines of blender's output to explain a failure.
+func lastLines(output string, n int) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
-	time.Sleep(30 * time.Second)
-	os.WriteFile("/tmp/c553_in/done.txt", []byte("done"), 0777)
+	return strings.Join(lines, "\n")
 }
 
 func DoesPathExists(p string) bool {
@@ -3,9 +3,39 @@ package main
 import (
 	"os/exec"
 	"time"
+
+	"github.com/saenuma/cartoons553/server/jobs"
 )
 
+// idleLimit is how long the server stays up when it is not in use before it shuts itself
+// down. It is never shut down while a job is queued or running.
+const idleLimit = 1 * time.Hour
+
 func main() {
-	time.Sleep(1 * time.Hour)
+	// the server is in use from the time it boots.
+	since := time.Now()
+	last := time.Now()
+	for {
+		time.Sleep(time.Minute)
+
+		// a server which was suspended and resumed gets the whole limit again. The wall clock
+		// moves on while the server is suspended but the monotonic clock doesn't.
+		now := time.Now()
+		if now.Round(0).Sub(last.Round(0)) > now.Sub(last)+5*time.Minute {
+			since = now
+		}
+		last = now
+
+		lastActive, busy := jobs.LastActive()
+		if busy {
+			continue
+		}
+		if lastActive.After(since) {
+			since = lastActive
+		}
+		if now.Round(0).Sub(since.Round(0)) >= idleLimit {
+			break
+		}
+	}
 	exec.Command("sudo", "shutdown", "-h", "now").Run()
 }
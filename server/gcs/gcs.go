@@ -0,0 +1,140 @@
+// Package gcs moves files between the render server and a Cloud Storage bucket.
+//
+// It uses the JSON API with the token of the server's service account. When the
+// STORAGE_EMULATOR_HOST environment variable is set, it talks to that emulator instead
+// without authentication.
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const TokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+var httpClient = &http.Client{Timeout: 2 * time.Hour}
+
+func endpoint() string {
+	if emulatorHost := os.Getenv("STORAGE_EMULATOR_HOST"); emulatorHost != "" {
+		if !strings.HasPrefix(emulatorHost, "http") {
+			emulatorHost = "http://" + emulatorHost
+		}
+		return strings.TrimSuffix(emulatorHost, "/")
+	}
+	return "https://storage.googleapis.com"
+}
+
+func authorize(req *http.Request) error {
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		return nil
+	}
+
+	tokenReq, err := http.NewRequest("GET", TokenURL, nil)
+	if err != nil {
+		return err
+	}
+	tokenReq.Header.Set("Metadata-Flavor", "Google")
+	resp, err := httpClient.Do(tokenReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return nil
+}
+
+func do(req *http.Request) (*http.Response, error) {
+	err := authorize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("cloud storage responded with %d: %s", resp.StatusCode, string(raw))
+	}
+
+	return resp, nil
+}
+
+// Download saves an object to outPath.
+func Download(bucket, object, outPath string) error {
+	req, err := http.NewRequest("GET", endpoint()+"/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+
+		url.PathEscape(object)+"?alt=media", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	os.MkdirAll(filepath.Dir(outPath), 0777)
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, resp.Body)
+	return err
+}
+
+// Upload puts the file at inPath in the bucket as object.
+func Upload(bucket, object, inPath string) error {
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	req, err := http.NewRequest("POST", endpoint()+"/upload/storage/v1/b/"+url.PathEscape(bucket)+
+		"/o?uploadType=media&name="+url.QueryEscape(object), inFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// UploadDir puts every file in dir in the bucket under prefix keeping their relative paths.
+func UploadDir(bucket, prefix, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return Upload(bucket, prefix+"/"+filepath.ToSlash(rel), path)
+	})
+}
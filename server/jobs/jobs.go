@@ -0,0 +1,426 @@
+// Package jobs is the queue of renders shared by the agents.
+//
+// c553_mover adds jobs to the queue and c553_render renders them one at a time in the
+// order they were added. Every job has a folder in Root with its blender file in 'in/',
+// its outputs in 'out/', the manifest of its outputs and a job.json with its settings
+// and status. A job can wait for other jobs and it is skipped when one of them does not
+// finish rendering. The job.json is only written by c553_mover when adding the job and by
+// c553_render afterwards. Cancelling a job is asked for with a 'cancel' file instead.
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Root is the folder of the queue. The data disk of the server is mounted there when it
+// has one.
+const Root = "/tmp/c553_jobs"
+
+// Version is the version of the agents. It is the version of the client which downloads
+// them and the client only works with agents of its own version.
+const Version = "14"
+
+// MinFreeSpace is the space in bytes kept free for the outputs of a job.
+const MinFreeSpace = 2 << 30
+
+// The statuses of a job.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Done      = "done"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+	// Skipped is for jobs which waited for a job that was not done.
+	Skipped = "skipped"
+)
+
+// Engines and Formats are the values blender accepts for the settings of a job.
+var (
+	Engines = []string{"CYCLES", "BLENDER_EEVEE", "BLENDER_EEVEE_NEXT", "BLENDER_WORKBENCH"}
+	Formats = []string{"AVIJPEG", "AVIRAW", "FFMPEG", "PNG", "JPEG", "BMP", "TIFF", "OPEN_EXR",
+		"OPEN_EXR_MULTILAYER", "TARGA", "WEBP"}
+)
+
+// Settings are how a job is rendered. Empty settings use what the blender file says
+// except for Engine and Format which default to CYCLES and AVIJPEG.
+//
+// Every combination of Scenes, Cameras and ViewLayers is rendered as a part of the job
+// with its own output folder.
+type Settings struct {
+	Scenes []string `json:"scenes,omitempty"`
+	// Cameras are camera objects or timeline markers bound to cameras.
+	Cameras    []string `json:"cameras,omitempty"`
+	ViewLayers []string `json:"view_layers,omitempty"`
+	// Frames is either a range like '1-120' or a list in blender's syntax like '1,5,10..20'.
+	Frames string `json:"frames,omitempty"`
+	Format string `json:"format,omitempty"`
+	Engine string `json:"engine,omitempty"`
+
+	// Still renders the Frames as images instead of an animation. Format then defaults to PNG.
+	Still bool `json:"still,omitempty"`
+	// Resolution is like '3840x2160'. The resolution of the blender file is used when empty.
+	Resolution string `json:"resolution,omitempty"`
+}
+
+var (
+	framesRegexp     = regexp.MustCompile(`^[0-9][0-9,.+\-]*$`)
+	resolutionRegexp = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+)
+
+// Validate checks the settings before they are passed to blender.
+func (settings Settings) Validate() error {
+	for _, names := range [][]string{settings.Scenes, settings.Cameras, settings.ViewLayers} {
+		for _, name := range names {
+			if name == "" || strings.HasPrefix(name, "-") || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+				return fmt.Errorf("the name '%s' is not valid", name)
+			}
+		}
+	}
+	if settings.Frames != "" && !framesRegexp.MatchString(settings.Frames) {
+		return fmt.Errorf("the frames '%s' are not like '1-120' or '1,5,10..20'", settings.Frames)
+	}
+	if settings.Still && settings.Frames == "" {
+		return fmt.Errorf("a still render needs the frames to render")
+	}
+	if settings.Resolution != "" && !resolutionRegexp.MatchString(settings.Resolution) {
+		return fmt.Errorf("the resolution '%s' is not like '3840x2160'", settings.Resolution)
+	}
+	if settings.Format != "" && !contains(Formats, settings.Format) {
+		return fmt.Errorf("the format '%s' is not one of %s", settings.Format, strings.Join(Formats, ", "))
+	}
+	if settings.Engine != "" && !contains(Engines, settings.Engine) {
+		return fmt.Errorf("the engine '%s' is not one of %s", settings.Engine, strings.Join(Engines, ", "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Part is a combination of a scene, a camera and a view layer to render. Empty fields
+// use what the blender file says.
+type Part struct {
+	Scene     string `json:"scene,omitempty"`
+	Camera    string `json:"camera,omitempty"`
+	ViewLayer string `json:"view_layer,omitempty"`
+	// Path is the folder of the outputs of the part relative to the output folder of the job.
+	Path   string `json:"path,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Parts returns every combination of the scenes, cameras and view layers of settings. Each
+// part's outputs go in a folder named after what was chosen like 'Scene/Camera/'. Without
+// any choice there is one part whose outputs are in the output folder itself.
+func (settings Settings) Parts() []Part {
+	orEmpty := func(names []string) []string {
+		if len(names) == 0 {
+			return []string{""}
+		}
+		return names
+	}
+
+	parts := make([]Part, 0)
+	for _, scene := range orEmpty(settings.Scenes) {
+		for _, camera := range orEmpty(settings.Cameras) {
+			for _, viewLayer := range orEmpty(settings.ViewLayers) {
+				part := Part{Scene: scene, Camera: camera, ViewLayer: viewLayer, Status: Queued}
+				part.Path = filepath.Join(scene, camera, viewLayer)
+				if part.Path == "." {
+					part.Path = ""
+				}
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// Job is a render in the queue.
+type Job struct {
+	ID   string `json:"id"`
+	File string `json:"file"`
+	Settings
+	Parts []Part `json:"parts"`
+
+	// After are the jobs to wait for by name. Their outputs are shared with this job in
+	// folders of those names next to its blender file.
+	After map[string]string `json:"after,omitempty"`
+	// From is a bake job whose baked blender file is rendered instead of an uploaded one.
+	From string `json:"from,omitempty"`
+	// Bake makes the job bake the simulations of its blender file instead of rendering it.
+	// The baked file and its caches are its outputs.
+	Bake bool `json:"bake,omitempty"`
+
+	// Bucket and Prefix are set for jobs staged in a bucket. Their outputs are put back in
+	// the bucket and the server is shut down after them when Shutdown is set, unless StopMode
+	// is suspend. The client then suspends the server so that it keeps its memory.
+	Bucket   string `json:"bucket,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Shutdown bool   `json:"shutdown,omitempty"`
+	StopMode string `json:"stop_mode,omitempty"`
+
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// IsFinished tells whether the job will not be rendered anymore.
+func (job *Job) IsFinished() bool {
+	return job.Status == Done || job.Status == Failed || job.Status == Cancelled || job.Status == Skipped
+}
+
+// Dependencies are the IDs of the jobs to finish before this job.
+func (job *Job) Dependencies() []string {
+	ids := make([]string, 0, len(job.After)+1)
+	for _, id := range job.After {
+		ids = append(ids, id)
+	}
+	if job.From != "" {
+		ids = append(ids, job.From)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+var (
+	idMutex sync.Mutex
+	lastID  int64
+)
+
+// New creates a queued job for a blender file. Its ID orders it after every earlier job.
+// The job is not in the queue until it is saved.
+func New(fileName string, settings Settings) *Job {
+	idMutex.Lock()
+	id := time.Now().UnixNano()
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	idMutex.Unlock()
+
+	job := &Job{
+		ID:       fmt.Sprintf("%d", id),
+		File:     filepath.Base(fileName),
+		Settings: settings,
+		Parts:    settings.Parts(),
+		Status:   Queued,
+		Queued:   time.Now(),
+	}
+	os.MkdirAll(InDir(job.ID), 0777)
+	os.MkdirAll(OutDir(job.ID), 0777)
+	return job
+}
+
+func Dir(id string) string {
+	return filepath.Join(Root, filepath.Base(id))
+}
+
+func InDir(id string) string {
+	return filepath.Join(Dir(id), "in")
+}
+
+func OutDir(id string) string {
+	return filepath.Join(Dir(id), "out")
+}
+
+func ManifestPath(id string) string {
+	return filepath.Join(Dir(id), "manifest.json")
+}
+
+// PreviewPath is where the last frame rendered by a job is kept as a PNG.
+func PreviewPath(id string) string {
+	return filepath.Join(Dir(id), "preview.png")
+}
+
+// InputPath is where the blender file of a job is kept.
+func (job *Job) InputPath() string {
+	return filepath.Join(InDir(job.ID), job.File)
+}
+
+// Save writes job.json. It is written to a temporary file first so that it is never
+// read half written.
+func Save(job *Job) error {
+	raw, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(Dir(job.ID), ".job.json")
+	err = os.WriteFile(tmpPath, raw, 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(Dir(job.ID), "job.json"))
+}
+
+func Load(id string) (*Job, error) {
+	raw, err := os.ReadFile(filepath.Join(Dir(id), "job.json"))
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	err = json.Unmarshal(raw, job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns every job in the order they were added. Folders without a job.json are
+// jobs still being added and are left out.
+func List() []*Job {
+	dirEntries, _ := os.ReadDir(Root)
+	list := make([]*Job, 0)
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		job, err := Load(dirEntry.Name())
+		if err != nil {
+			continue
+		}
+		list = append(list, job)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].ID) != len(list[j].ID) {
+			return len(list[i].ID) < len(list[j].ID)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Next returns the oldest queued job whose dependencies are finished. It is nil when no
+// job can begin.
+func Next() *Job {
+	list := List()
+	byID := make(map[string]*Job)
+	for _, job := range list {
+		byID[job.ID] = job
+	}
+
+	for _, job := range list {
+		if job.Status != Queued {
+			continue
+		}
+		ready := true
+		for _, id := range job.Dependencies() {
+			if dependency, ok := byID[id]; ok && !dependency.IsFinished() {
+				ready = false
+			}
+		}
+		if ready {
+			return job
+		}
+	}
+	return nil
+}
+
+// FailedDependency returns the name of a dependency of job which is not done. It is empty
+// when every dependency is done.
+func FailedDependency(job *Job) string {
+	for name, id := range job.After {
+		dependency, err := Load(id)
+		if err != nil || dependency.Status != Done {
+			return name
+		}
+	}
+	if job.From != "" {
+		dependency, err := Load(job.From)
+		if err != nil || dependency.Status != Done {
+			return "the bake"
+		}
+	}
+	return ""
+}
+
+// Cancel asks for a job to be cancelled.
+func Cancel(id string) error {
+	return os.WriteFile(filepath.Join(Dir(id), "cancel"), []byte("cancel"), 0777)
+}
+
+func IsCancelled(id string) bool {
+	_, err := os.Stat(filepath.Join(Dir(id), "cancel"))
+	return err == nil
+}
+
+// activityPath is a file touched by c553_mover while it serves the client.
+func activityPath() string {
+	return filepath.Join(Root, "activity")
+}
+
+// Touch records that the server is in use by the client.
+func Touch() {
+	now := time.Now()
+	err := os.Chtimes(activityPath(), now, now)
+	if os.IsNotExist(err) {
+		os.WriteFile(activityPath(), []byte("activity"), 0777)
+	}
+}
+
+// LastActive is when the server was last in use: when the client was last served or a job
+// was last added or finished. It is zero when the server was never in use.
+//
+// busy tells whether a job is queued or running. Such a server is in use whatever the time.
+func LastActive() (last time.Time, busy bool) {
+	if stat, err := os.Stat(activityPath()); err == nil {
+		last = stat.ModTime()
+	}
+	for _, job := range List() {
+		if !job.IsFinished() {
+			busy = true
+		}
+		for _, at := range []time.Time{job.Queued, job.Finished} {
+			if at.After(last) {
+				last = at
+			}
+		}
+	}
+	return last, busy
+}
+
+// FreeSpace returns the space in bytes left on the disk of the queue.
+func FreeSpace() (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(Root, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// CheckFreeSpace returns an error when the disk of the queue can't take a blender file of
+// size bytes and still have MinFreeSpace left for the outputs.
+func CheckFreeSpace(size int64) error {
+	free, err := FreeSpace()
+	if err != nil {
+		return err
+	}
+	needed := uint64(MinFreeSpace)
+	if size > 0 {
+		needed += uint64(size)
+	}
+	if free < needed {
+		return fmt.Errorf("the render server has %.1f GB free but needs %.1f GB. Delete old renders or use a "+
+			"bigger disk_size_gb or data_disk_size_gb", float64(free)/(1<<30), float64(needed)/(1<<30))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestEntry is an output of a job. Path is relative to the output folder of the job.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest lists the outputs of a job. The client checks its downloads against it.
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+// FileSHA256 returns the size and SHA-256 of a file.
+func FileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteManifest lists every output of a job with its checksum in its ManifestPath.
+func WriteManifest(id string) error {
+	outDir := OutDir(id)
+	manifest := Manifest{Files: make([]ManifestEntry, 0)}
+	err := filepath.WalkDir(outDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		size, sum, err := FileSHA256(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outDir, path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{Path: filepath.ToSlash(rel), Size: size, SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ManifestPath(id), raw, 0777)
+}
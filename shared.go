@@ -1,18 +1,52 @@
 package main
 
 import (
-	"io"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+var (
+	// httpTransport limits how long connecting to a server and waiting for its response take.
+	httpTransport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	}
+
+	// httpClient is for short requests.
+	httpClient = &http.Client{Transport: httpTransport, Timeout: time.Minute}
+
+	// transferClient is for uploads and downloads. They are limited by the contexts of
+	// their requests as they can take long.
+	transferClient = &http.Client{Transport: httpTransport}
+)
+
+// workdir is the working directory given with the --workdir flag. It takes precedence over
+// the C553_WORKDIR environment variable.
+var workdir string
+
+// GetRootPath returns the working directory where the serverConfigFiles, keys, blender files
+// and outputs are kept. It is '~/cartoons553' unless --workdir or C553_WORKDIR is given.
 func GetRootPath() (string, error) {
+	if dd := firstNonEmpty(workdir, os.Getenv("C553_WORKDIR")); dd != "" {
+		dd, err := filepath.Abs(dd)
+		if err != nil {
+			return "", errors.Wrap(err, "os error")
+		}
+		os.MkdirAll(dd, 0777)
+		return dd, nil
+	}
+
 	hd, err := os.UserHomeDir()
 	if err != nil {
 		return "", errors.Wrap(err, "os error")
@@ -26,6 +60,15 @@ func GetRootPath() (string, error) {
 	return dd, nil
 }
 
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
 func UntestedRandomString(length int) string {
 	var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	const charset = "abcdefghijklmnopqrstuvwxyz1234567890"
@@ -37,45 +80,158 @@ func UntestedRandomString(length int) string {
 	return string(b)
 }
 
-func DoesPathExists(p string) bool {
-	if _, err := os.Stat(p); os.IsNotExist(err) {
-		return false
+// parseArgs splits command line arguments into positional arguments and flags.
+// Flags are written as '--name value' or '--name=value'. Flags listed in boolFlags
+// take no value.
+func parseArgs(args []string) ([]string, map[string]string) {
+	positional := make([]string, 0)
+	flags := make(map[string]string)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") || arg == "--" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		if eqIndex := strings.Index(name, "="); eqIndex != -1 {
+			flags[name[:eqIndex]] = name[eqIndex+1:]
+			continue
+		}
+
+		if boolFlags[name] {
+			flags[name] = "true"
+			continue
+		}
+
+		if i+1 < len(args) {
+			flags[name] = args[i+1]
+			i++
+		} else {
+			flags[name] = ""
+		}
 	}
-	return true
+
+	return positional, flags
 }
 
-func downloadFile(url, outPath string) error {
-	if DoesPathExists(outPath) {
-		return nil
+// boolFlags are the flags which do not expect a value.
+var boolFlags = map[string]bool{
+	"json":   true,
+	"help":   true,
+	"detach": true,
+
+	"overwrite": true,
+	"archive":   true,
+	"still":     true,
+
+	"restore-machine-type": true,
+	"move-zone":            true,
+}
+
+// valueFlags are the flags which expect a value.
+var valueFlags = map[string]bool{
+	"workdir":      true,
+	"on-interrupt": true,
+
+	"project":      true,
+	"region":       true,
+	"zone":         true,
+	"machine-type": true,
+	"sak-file":     true,
+	"quality":      true,
+
+	"scenes":      true,
+	"cameras":     true,
+	"view-layers": true,
+	"frames":      true,
+	"format":      true,
+	"resolution":  true,
+
+	"machine-types": true,
+	"target":        true,
+	"debounce":      true,
+
+	"since":   true,
+	"until":   true,
+	"command": true,
+	"status":  true,
+	"server":  true,
+	"blend":   true,
+}
+
+// globalFlags are the flags every command has.
+var globalFlags = []string{"json", "help", "workdir"}
+
+// commandFlags are the flags of each command along with the globalFlags.
+var commandFlags = map[string][]string{
+	"init": {"project", "region", "zone", "machine-type", "sak-file", "quality"},
+	"rnd": {"detach", "overwrite", "archive", "scenes", "cameras", "view-layers", "frames", "still", "format",
+		"resolution", "machine-type", "restore-machine-type", "move-zone", "on-interrupt"},
+	"bench":   {"machine-types", "target", "scenes", "cameras", "view-layers", "frames", "resolution", "move-zone"},
+	"batch":   {"overwrite", "archive", "move-zone"},
+	"watch":   {"debounce", "move-zone"},
+	"attach":  {"overwrite", "archive", "move-zone", "on-interrupt"},
+	"history": {"since", "until", "command", "status", "server", "blend"},
+}
+
+// commandUsages are how the commands are run. They are shown when a command is given the
+// wrong arguments.
+var commandUsages = map[string]string{
+	"init":    "cartoons553 init [serverConfigFile] [--project, --region, --zone, --machine-type, --sak-file, --quality]",
+	"prep":    "cartoons553 prep [serverConfigFile]",
+	"rnd":     "cartoons553 rnd blenderFile serverConfigFile [flags]",
+	"bench":   "cartoons553 bench blenderFile serverConfigFile [flags]",
+	"batch":   "cartoons553 batch [batchFile serverConfigFile] [flags]",
+	"watch":   "cartoons553 watch serverConfigFile [--debounce]",
+	"attach":  "cartoons553 attach serverConfigFile [flags]",
+	"preview": "cartoons553 preview serverConfigFile",
+	"fetch":   "cartoons553 fetch serverConfigFile",
+	"history": "cartoons553 history [--since, --until, --command, --status, --server, --blend]",
+	"del":     "cartoons553 del serverConfigFile",
+}
+
+// usageError is a ConfigError for a command given the wrong arguments. It tells how the
+// command is run.
+func usageError(command, format string, a ...any) error {
+	usage, ok := commandUsages[command]
+	if !ok {
+		usage = "cartoons553 command [arguments] [flags]"
 	}
+	return newError(ConfigError, "%s\nUsage: %s\nRun with the help subcommand to view help.",
+		fmt.Sprintf(format, a...), usage)
+}
 
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		return errors.Wrap(err, "http error")
+// checkFlags rejects the flags command doesn't have so that a misspelt or misplaced flag is
+// not ignored. Help and unknown commands take any flag as they have their own messages.
+func checkFlags(command string, flags map[string]string) error {
+	if command == "help" || command == "h" {
+		return nil
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return errors.Wrap(err, "io error")
+	if _, ok := commandUsages[command]; !ok {
+		return nil
 	}
 
-	if resp.StatusCode != 200 {
-		return errors.New(string(body))
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
 	}
-
-	out, err := os.Create(outPath)
-	if err != nil {
-		return errors.Wrap(err, "os error")
+	sort.Strings(names)
+	for _, name := range names {
+		if !boolFlags[name] && !valueFlags[name] {
+			return usageError(command, "Unknown flag '--%s'", name)
+		}
+		if !isOneOf(globalFlags, name) && !isOneOf(commandFlags[command], name) {
+			return usageError(command, "The %s command has no '--%s' flag", command, name)
+		}
 	}
-	defer out.Close()
+	return nil
+}
 
-	// Write the body to file
-	_, err = out.Write(body)
-	if err != nil {
-		return errors.Wrap(err, "io error")
+func DoesPathExists(p string) bool {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return false
 	}
-
-	// fmt.Println("Downloaded: " + filepath.Base(url))
-	return nil
+	return true
 }
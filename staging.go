@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// newStorageService connects to Cloud Storage. The STORAGE_EMULATOR_HOST environment
+// variable points it to an emulator like fake-gcs-server for testing.
+func newStorageService(ctx context.Context, conf zazabul.Config) (*storage.Service, error) {
+	var opts []option.ClientOption
+	if emulatorHost := os.Getenv("STORAGE_EMULATOR_HOST"); emulatorHost != "" {
+		if !strings.HasPrefix(emulatorHost, "http") {
+			emulatorHost = "http://" + emulatorHost
+		}
+		opts = append(opts, option.WithEndpoint(emulatorHost+"/storage/v1/"), option.WithoutAuthentication())
+	} else {
+		credentialsFilePath := conf.Get("sak_file")
+		opts = append(opts, option.WithCredentialsFile(credentialsFilePath),
+			option.WithScopes(storage.DevstorageReadWriteScope))
+	}
+
+	storageService, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, wrapError(AuthError, err, "could not connect to Cloud Storage")
+	}
+
+	return storageService, nil
+}
+
+// stagingPrefix is where the files of a render are kept in the bucket. The blender file
+// is put in 'in/', the outputs in 'out/' and a 'done.txt' marks the render as finished.
+func stagingPrefix(instanceName, jobID string) string {
+	return path.Join("c553", instanceName, jobID)
+}
+
+func uploadToBucket(ctx context.Context, storageService *storage.Service, bucket, objectName, localPath string) error {
+	inFile, err := os.Open(localPath)
+	if err != nil {
+		return wrapError(ConfigError, err, "could not read the blender file")
+	}
+	defer inFile.Close()
+
+	_, err = storageService.Objects.Insert(bucket, &storage.Object{Name: objectName}).Media(inFile).Context(ctx).Do()
+	if err != nil {
+		return wrapError(AgentError, interruptedOr(ctx, err), "could not upload to the bucket")
+	}
+
+	return nil
+}
+
+// isStagedRenderDone tells whether the agent has finished a render and put its outputs in
+// the bucket. A render which finished without being done, like one which failed or whose
+// outputs could not be uploaded, gives true and a RenderError.
+func isStagedRenderDone(ctx context.Context, storageService *storage.Service, bucket, prefix string) (bool, error) {
+	resp, err := storageService.Objects.Get(bucket, path.Join(prefix, "done.txt")).Context(ctx).Download()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapError(RenderError, interruptedOr(ctx, err), "could not check the bucket")
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, wrapError(RenderError, interruptedOr(ctx, err), "could not check the bucket")
+	}
+
+	// done.txt has the status of the render and then its error.
+	status, renderErr, _ := strings.Cut(strings.TrimSpace(string(raw)), "\n")
+	if strings.TrimSpace(status) != "done" {
+		return true, newError(RenderError, "The render %s: %s", strings.TrimSpace(status), strings.TrimSpace(renderErr))
+	}
+	return true, nil
+}
+
+// downloadStagedOutputs mirrors the outputs of a render from the bucket into outDir.
+func downloadStagedOutputs(ctx context.Context, storageService *storage.Service, bucket, prefix, outDir string,
+	policy ExistsPolicy) error {
+	outPrefix := path.Join(prefix, "out") + "/"
+	names := make([]string, 0)
+	err := storageService.Objects.List(bucket).Prefix(outPrefix).Pages(ctx, func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			names = append(names, object.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return wrapError(RenderError, interruptedOr(ctx, err), "could not list the outputs in the bucket")
+	}
+	if len(names) == 0 {
+		return newError(RenderError, "the render made no outputs")
+	}
+
+	manifest, err := getStagedManifest(ctx, storageService, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]ManifestEntry)
+	for _, entry := range manifest.Files {
+		entries[entry.Path] = entry
+	}
+
+	downloads := make(map[string]ManifestEntry)
+	mismatches := make([]string, 0)
+	for _, name := range names {
+		relPath := strings.TrimPrefix(name, outPrefix)
+		if _, ok := entries[relPath]; !ok {
+			mismatches = append(mismatches, relPath)
+			continue
+		}
+		outPath, err := localOutputPath(outDir, relPath)
+		if err != nil {
+			return err
+		}
+		downloads[outPath] = entries[relPath]
+	}
+	if len(mismatches) > 0 {
+		return newError(RenderError, "the bucket has outputs which are not in the manifest: %s",
+			strings.Join(mismatches, ", "))
+	}
+	if len(names) != len(manifest.Files) {
+		return newError(RenderError, "the bucket has %d outputs but the manifest lists %d", len(names),
+			len(manifest.Files))
+	}
+
+	for localPath, entry := range downloads {
+		err = downloadObject(ctx, storageService, bucket, path.Join(outPrefix, entry.Path), localPath, policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return verifyDownloads(downloads)
+}
+
+// getStagedManifest gets the list of outputs the agents put in the bucket.
+func getStagedManifest(ctx context.Context, storageService *storage.Service, bucket, prefix string) (*Manifest, error) {
+	resp, err := storageService.Objects.Get(bucket, path.Join(prefix, "manifest.json")).Context(ctx).Download()
+	if err != nil {
+		return nil, wrapError(RenderError, interruptedOr(ctx, err), "could not get the manifest of the outputs")
+	}
+	defer resp.Body.Close()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(resp.Body).Decode(manifest)
+	if err != nil {
+		return nil, wrapError(RenderError, err, "could not read the manifest of the outputs")
+	}
+
+	return manifest, nil
+}
+
+func downloadObject(ctx context.Context, storageService *storage.Service, bucket, objectName, localPath string,
+	policy ExistsPolicy) error {
+	err := streamDownload(ctx, localPath, policy, func(ctx context.Context, offset int64) (*http.Response, error) {
+		call := storageService.Objects.Get(bucket, objectName).Context(ctx)
+		if offset > 0 {
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := call.Download()
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusRequestedRangeNotSatisfiable {
+			return &http.Response{StatusCode: apiErr.Code, Body: http.NoBody}, nil
+		}
+		return resp, err
+	})
+	if err != nil {
+		return wrapError(RenderError, err, "could not download '"+objectName+"'")
+	}
+
+	return nil
+}
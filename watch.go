@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/radovskyb/watcher"
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// defaultDebounce is how long a blender file must be left unchanged before it is rendered
+// in watch mode.
+const defaultDebounce = 10 * time.Second
+
+// watchedJob is a blender file rendering in watch mode.
+type watchedJob struct {
+	JobID         string
+	BlenderPath   string
+	BlenderSHA256 string
+	Settings      RenderSettings
+	QueuedTime    time.Time
+}
+
+// watchSession is the state of the watch command. The server is started when a blender
+// file is to be rendered and stopped when every render is done.
+type watchSession struct {
+	conf           zazabul.Config
+	configPath     string
+	computeService *compute.Service
+	instanceName   string
+	machineType    string
+	timeouts       Timeouts
+	outputsPath    string
+
+	agent     *Agent
+	startTime time.Time
+	uptime    time.Duration
+	jobs      map[string]*watchedJob
+	lastSums  map[string]string
+}
+
+// doWatch renders the blender files which are saved to the working directory until it
+// is interrupted. The outputs of a file are put in 'outputs/<file name>/'.
+func doWatch(ctx context.Context, serverConfigPath string, debounce time.Duration) (result *CommandResult, err error) {
+	rootPath, _ := GetRootPath()
+
+	conf, instanceName, err := loadFreeServer(rootPath, serverConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	computeService, err := newComputeService(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	machineType, err := serverMachineType(ctx, computeService, conf, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, _ := getTimeouts(conf)
+	session := &watchSession{
+		conf:           conf,
+		configPath:     serverConfigPath,
+		computeService: computeService,
+		instanceName:   instanceName,
+		machineType:    machineType,
+		timeouts:       timeouts,
+		outputsPath:    filepath.Join(rootPath, "outputs"),
+		jobs:           make(map[string]*watchedJob),
+		lastSums:       make(map[string]string),
+	}
+	defer session.stop()
+
+	w := watcher.New()
+	w.FilterOps(watcher.Create, watcher.Write, watcher.Rename, watcher.Move)
+	err = w.Add(rootPath)
+	if err != nil {
+		return nil, wrapError(ConfigError, err, "could not watch the working directory")
+	}
+	go func() {
+		if err := w.Start(time.Second); err != nil {
+			fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+		}
+	}()
+	defer w.Close()
+
+	fmt.Fprintf(out, "Watching '%s' for blender files. Press Ctrl-C to stop.\n", rootPath)
+
+	// changes are the blender files which changed and when they last did.
+	changes := make(map[string]time.Time)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	lastPoll := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(out, "\nStopped watching.")
+			session.stop()
+			cost := 0.0
+			if session.uptime > 0 {
+				cost = estimateCost(context.Background(), computeService, conf, machineType, session.uptime)
+				fmt.Fprintf(out, "Estimated cost: $%.2f\n", cost)
+			}
+			return &CommandResult{
+				Command:       "watch",
+				Instance:      instanceName,
+				ConfigPath:    serverConfigPath,
+				OutputPath:    session.outputsPath,
+				MachineType:   machineType,
+				Duration:      session.uptime.Seconds(),
+				EstimatedCost: cost,
+			}, nil
+
+		case event := <-w.Event:
+			if event.IsDir() || filepath.Ext(event.Path) != ".blend" {
+				continue
+			}
+			changes[event.Path] = time.Now()
+
+		case err := <-w.Error:
+			fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+
+		case <-ticker.C:
+			due := make([]string, 0)
+			for blenderPath, changeTime := range changes {
+				if time.Since(changeTime) >= debounce {
+					due = append(due, blenderPath)
+				}
+			}
+			sort.Strings(due)
+			for _, blenderPath := range due {
+				delete(changes, blenderPath)
+				err := session.submit(ctx, blenderPath)
+				if err != nil {
+					if ctx.Err() != nil {
+						break
+					}
+					fmt.Fprintln(out, color.Red.Sprintf("Could not render '%s': %s", filepath.Base(blenderPath), err))
+				}
+			}
+
+			if session.agent != nil && time.Since(lastPoll) >= 10*time.Second {
+				lastPoll = time.Now()
+				session.poll(ctx)
+				if len(session.jobs) == 0 && len(changes) == 0 {
+					session.stop()
+				}
+			}
+		}
+	}
+}
+
+// submit queues a blender file on the server, starting the server when needed. A file
+// which is still rendering is cancelled first. Files saved without changes are skipped.
+func (session *watchSession) submit(ctx context.Context, blenderPath string) error {
+	_, sum, err := fileSHA256(blenderPath)
+	if err != nil {
+		return err
+	}
+	if session.lastSums[blenderPath] == sum {
+		return nil
+	}
+
+	if session.agent == nil {
+		fmt.Fprintln(out, "Starting the render server.")
+		session.startTime = time.Now()
+		agent, err := startServer(ctx, session.computeService, session.conf, session.configPath, session.instanceName)
+		if err != nil {
+			session.stop()
+			return err
+		}
+		session.agent = agent
+	}
+
+	if job, ok := session.jobs[blenderPath]; ok {
+		cancelRender(session.agent, job.JobID)
+		delete(session.jobs, blenderPath)
+	}
+
+	settings := RenderSettings{Engine: qualityEngines[session.conf.Get("quality")]}
+	jobID, err := submitBlend(ctx, session.agent, blenderPath, settings.form(), session.timeouts.Upload)
+	if err != nil {
+		return err
+	}
+	session.jobs[blenderPath] = &watchedJob{JobID: jobID, BlenderPath: blenderPath, BlenderSHA256: sum,
+		Settings: settings, QueuedTime: time.Now()}
+	session.lastSums[blenderPath] = sum
+	fmt.Fprintf(out, "Rendering '%s'\n", filepath.Base(blenderPath))
+	return nil
+}
+
+// poll downloads the outputs of the renders which are done.
+func (session *watchSession) poll(ctx context.Context) {
+	for blenderPath, job := range session.jobs {
+		agentJob, err := getAgentJob(ctx, session.agent, job.JobID)
+		if err != nil {
+			fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+			continue
+		}
+		if !agentJob.IsFinished() {
+			if time.Since(job.QueuedTime) > session.timeouts.Render {
+				cancelRender(session.agent, job.JobID)
+				delete(session.jobs, blenderPath)
+				fmt.Fprintln(out, color.Red.Sprint(timeoutError(RenderError, "the render of '"+filepath.Base(blenderPath)+"'",
+					session.timeouts.Render).Error()))
+			}
+			continue
+		}
+
+		delete(session.jobs, blenderPath)
+		event := &HookEvent{Command: "watch", Job: job.JobID, Blend: blenderPath, Status: agentJob.Status,
+			Error: agentJob.Error, Duration: time.Since(job.QueuedTime).Seconds()}
+		if agentJob.Status != "done" {
+			delete(session.lastSums, blenderPath)
+			fmt.Fprintln(out, color.Red.Sprintf("The render of '%s' %s: %s", filepath.Base(blenderPath), agentJob.Status,
+				agentJob.Error))
+			session.finish(job, event)
+			continue
+		}
+
+		outDir := filepath.Join(session.outputsPath, strings.TrimSuffix(filepath.Base(blenderPath), ".blend"))
+		err = downloadJobOutputs(ctx, session.agent, job.JobID, outDir, OverwriteExisting, false)
+		if err != nil {
+			fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+			event.Status, event.Error = "failed", err.Error()
+			session.finish(job, event)
+			continue
+		}
+		fmt.Fprintf(out, "Rendered '%s' to %s\n", filepath.Base(blenderPath), outDir)
+		event.OutputPath = outDir
+		session.finish(job, event)
+	}
+}
+
+// finish runs the hook of a render which is over and records it in the history. The cost of
+// the server is only recorded when watch stops as it is shared by the renders.
+func (session *watchSession) finish(job *watchedJob, event *HookEvent) {
+	runHook(session.conf, event)
+	appendHistory(&HistoryRecord{
+		Command:     "watch",
+		Config:      session.configPath,
+		Server:      session.instanceName,
+		MachineType: session.machineType,
+		Job:         job.JobID,
+		Blend:       job.BlenderPath,
+		BlendSHA256: job.BlenderSHA256,
+		Settings:    &job.Settings,
+		Start:       job.QueuedTime,
+		End:         time.Now(),
+		Status:      event.Status,
+		Error:       event.Error,
+		OutputPath:  event.OutputPath,
+	})
+}
+
+// stop stops the server if it was started.
+func (session *watchSession) stop() {
+	if session.agent == nil && session.startTime.IsZero() {
+		return
+	}
+	for _, job := range session.jobs {
+		cancelRender(session.agent, job.JobID)
+	}
+	session.jobs = make(map[string]*watchedJob)
+
+	err := parkInstance(context.Background(), session.computeService, session.conf, session.instanceName)
+	if err != nil {
+		fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+		return
+	}
+	session.uptime += time.Since(session.startTime)
+	session.agent = nil
+	session.startTime = time.Time{}
+	fmt.Fprintf(out, "Server %s.\n", parkedState(session.conf))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/pkg/errors"
+	"github.com/saenuma/zazabul"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// moveZone is set by the --move-zone flag. A server which can't start in its zone is then
+// moved to a fallback zone without asking.
+var moveZone bool
+
+// zoneLineRegexp finds the zone of a serverConfigFile so that it can be changed to where the
+// server ends up.
+var zoneLineRegexp = regexp.MustCompile(`(?m)^zone:.*$`)
+
+// candidateZones are the zones a server may be in: the zone of conf first and then its
+// fallback_zones.
+func candidateZones(ctx context.Context, computeService *compute.Service, conf zazabul.Config) ([]string, error) {
+	zones := []string{conf.Get("zone")}
+	fallbackZones := strings.TrimSpace(conf.Get("fallback_zones"))
+	if fallbackZones != "any" {
+		return uniqueStrings(append(zones, strings.Split(fallbackZones, ",")...)), nil
+	}
+
+	err := computeService.Zones.List(conf.Get("project")).Pages(ctx, func(page *compute.ZoneList) error {
+		for _, zone := range page.Items {
+			if path.Base(zone.Region) == conf.Get("region") && zone.Status == "UP" {
+				zones = append(zones, zone.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError(ProvisioningError, interruptedOr(ctx, err), "could not list the zones of "+conf.Get("region"))
+	}
+	return uniqueStrings(zones), nil
+}
+
+// isQuotaError tells if err is because Google Cloud had no room or quota for the server.
+func isQuotaError(err error) bool {
+	var c553Err *C553Error
+	return errors.As(err, &c553Err) && c553Err.Kind == QuotaError
+}
+
+// persistZone changes the zone of a serverConfigFile.
+func persistZone(serverConfigPath, zone string) error {
+	raw, err := os.ReadFile(serverConfigPath)
+	if err == nil {
+		err = os.WriteFile(serverConfigPath, []byte(zoneLineRegexp.ReplaceAllString(string(raw), "zone: "+zone)), 0777)
+	}
+	if err != nil {
+		return wrapError(ConfigError, err, "could not save the zone of the render server to the serverConfigFile")
+	}
+	return nil
+}
+
+// shouldMove asks whether to move a server which has no room in its zone. It is moved
+// without asking with --move-zone and never in json mode.
+func shouldMove(zone string) bool {
+	if moveZone {
+		return true
+	}
+	if jsonMode {
+		return false
+	}
+
+	fmt.Fprintf(out, "%s has no room for the render server. It can be moved to another zone but the files on its "+
+		"data disk are lost. Move it? [y/N]: ", zone)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(line)) == "y"
+}
+
+// moveServer recreates a stopped server in the first of zones with room for it and deletes
+// the old one. The new server boots from a snapshot of the old boot disk and has the same
+// machine type, disks and labels. The data disk starts empty. The zone of conf and of its
+// serverConfigFile is changed to the new zone.
+func moveServer(ctx context.Context, computeService *compute.Service, conf zazabul.Config, serverConfigPath,
+	instanceName string, zones []string) (err error) {
+	timeouts, _ := getTimeouts(conf)
+	project, oldZone := conf.Get("project"), conf.Get("zone")
+
+	old, err := computeService.Instances.Get(project, oldZone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, interruptedOr(ctx, err), "could not get the render server's details")
+	}
+	var bootDisk string
+	disks := DiskSettings{}
+	for _, attached := range old.Disks {
+		disk, err := computeService.Disks.Get(project, oldZone, path.Base(attached.Source)).Context(ctx).Do()
+		if err != nil {
+			return wrapError(ProvisioningError, interruptedOr(ctx, err), "could not get the render server's disks")
+		}
+		if attached.Boot {
+			bootDisk = disk.Name
+			disks.SizeGb, disks.Type = disk.SizeGb, path.Base(disk.Type)
+		} else {
+			disks.DataSizeGb = disk.SizeGb
+		}
+	}
+
+	fmt.Fprintf(out, "Taking a snapshot of the render server in %s\n", oldZone)
+	// the name has the time so that a snapshot left by an interrupted move doesn't stop the next.
+	snapshotName := fmt.Sprintf("%s-move-%d", instanceName, time.Now().Unix())
+	op, err := computeService.Disks.CreateSnapshot(project, oldZone, bootDisk, &compute.Snapshot{Name: snapshotName}).
+		Context(ctx).Do()
+	if err == nil {
+		err = waitForOperationZone(ctx, project, oldZone, computeService, op, timeouts.Operation)
+	}
+	if err != nil {
+		return wrapError(ProvisioningError, err, "could not take a snapshot of the render server")
+	}
+	defer func() {
+		op, deleteErr := computeService.Snapshots.Delete(project, snapshotName).Context(context.Background()).Do()
+		if deleteErr == nil {
+			deleteErr = waitForOperationGlobal(context.Background(), project, computeService, op, timeouts.Operation)
+		}
+		if deleteErr != nil {
+			fmt.Fprintln(out, color.Red.Sprint(wrapError(ProvisioningError, deleteErr, "could not delete the snapshot "+
+				snapshotName).Error()))
+		}
+	}()
+	snapshot, err := computeService.Snapshots.Get(project, snapshotName).Context(ctx).Do()
+	if err != nil {
+		return wrapError(ProvisioningError, interruptedOr(ctx, err), "could not get the snapshot of the render server")
+	}
+
+	// the zone of conf is changed back when the server couldn't be moved.
+	defer func() {
+		if err != nil {
+			conf.Update(map[string]string{"zone": oldZone})
+		}
+	}()
+	for i, zone := range zones {
+		fmt.Fprintf(out, "Moving the render server to %s\n", zone)
+		conf.Update(map[string]string{"zone": zone})
+		boot := &compute.AttachedDiskInitializeParams{SourceSnapshot: snapshot.SelfLink}
+		instance := serverInstance(conf, instanceName, path.Base(old.MachineType), disks, boot, old.Metadata.Items,
+			old.Labels)
+
+		op, err = computeService.Instances.Insert(project, zone, instance).Context(ctx).Do()
+		if err == nil {
+			err = waitForOperationZone(ctx, project, zone, computeService, op, timeouts.Operation)
+			if err != nil {
+				deleteInstance(context.Background(), computeService, conf, instanceName)
+			}
+		}
+		if err == nil {
+			break
+		}
+		err = wrapError(ProvisioningError, err, "could not move the render server to "+zone)
+		if !isQuotaError(err) || i == len(zones)-1 {
+			return err
+		}
+		fmt.Fprintln(out, color.Red.Sprint(err.Error()))
+	}
+
+	err = persistZone(serverConfigPath, conf.Get("zone"))
+	if err != nil {
+		return err
+	}
+
+	op, deleteErr := computeService.Instances.Delete(project, oldZone, instanceName).Context(ctx).Do()
+	if deleteErr == nil {
+		deleteErr = waitForOperationZone(ctx, project, oldZone, computeService, op, timeouts.Operation)
+	}
+	if deleteErr != nil {
+		fmt.Fprintln(out, color.Red.Sprintf("could not delete the old render server in %s. Delete it from the "+
+			"Google Cloud console: %s", oldZone, deleteErr))
+	}
+
+	fmt.Fprintf(out, "Moved the render server to %s\n", conf.Get("zone"))
+	return nil
+}